@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+// AddAlias makes oldID another name for the stream newID, so streams can be
+// renamed without clients noticing. Every server method given oldID uses
+// newID in its place, so subscribing or publishing to oldID attaches to the
+// newID stream, and clients reconnecting to it are replayed from that
+// streams eventlog. Aliases to oldID are moved to newID.
+//
+// ErrInvalidAlias is returned if oldID is the id of an existing stream, or
+// if newID is, or is an alias of, oldID.
+func (s *Server) AddAlias(oldID, newID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newID = s.resolve(newID)
+	if oldID == newID || s.Streams[oldID] != nil {
+		return ErrInvalidAlias
+	}
+
+	if s.aliases == nil {
+		s.aliases = make(map[string]string)
+	}
+
+	for alias, target := range s.aliases {
+		if target == oldID {
+			s.aliases[alias] = newID
+		}
+	}
+	s.aliases[oldID] = newID
+
+	return nil
+}
+
+// RemoveAlias removes an alias added with AddAlias, leaving the stream it
+// referred to in place
+func (s *Server) RemoveAlias(oldID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.aliases, oldID)
+}
+
+// resolve returns the id of the stream an id refers to. Aliases always
+// refer directly to a stream id, so are never chained. The caller must
+// hold the servers lock.
+func (s *Server) resolve(id string) string {
+	if target, ok := s.aliases[id]; ok {
+		return target
+	}
+	return id
+}
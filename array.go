@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// StreamArrayHandler returns a handler that writes a streams eventlog,
+// followed by the events published during window, as a single json array.
+// Events are written as they arrive, and the array is closed once window
+// has passed or the stream closes, so the response is always a complete
+// json document, even if it holds no events.
+func StreamArrayHandler(str *Stream, window time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, ok := subscribeRequest(str, w, r)
+		if !ok {
+			return
+		}
+		defer sub.Close()
+
+		c := sub.connect("0", "", ConnectionMetadata{
+			UserAgent:  r.UserAgent(),
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header,
+		})
+		// the window can end with events still waiting on the connection,
+		// so close it rather than leave the stream blocked on it
+		defer c.close(nil)
+
+		t := time.NewTimer(window)
+		defer t.Stop()
+
+		flush := newFlusher(w)
+		if flush == nil {
+			flush = func() error { return nil }
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if _, err := w.Write([]byte("[")); err != nil {
+			return
+		}
+		if err := flush(); err != nil {
+			return
+		}
+
+		var written int
+		for {
+			select {
+			case e, ok := <-c.conn:
+				if !ok {
+					_, _ = w.Write([]byte("]\n"))
+					return
+				}
+				if e.catchUp {
+					continue
+				}
+
+				data, err := json.Marshal(newJSONEvent(e))
+				if err != nil {
+					continue
+				}
+				if written > 0 {
+					data = append([]byte(","), data...)
+				}
+				written++
+
+				if _, err := w.Write(data); err != nil {
+					return
+				}
+				if err := flush(); err != nil {
+					return
+				}
+			case <-t.C:
+				_, _ = w.Write([]byte("]\n"))
+				return
+			case <-str.done:
+				_, _ = w.Write([]byte("]\n"))
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
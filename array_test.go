@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamArrayHandler(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/bulk", nil)
+		rec := httptest.NewRecorder()
+		StreamArrayHandler(s, time.Millisecond*200).ServeHTTP(rec, req)
+		return rec
+	}
+
+	start := time.Now()
+	rec := get()
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "[]\n", rec.Body.String())
+	assert.True(t, time.Since(start) >= time.Millisecond*200)
+
+	for i := 0; i < 2; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		s.publish(&Event{Data: []byte("2")})
+	}()
+
+	rec = get()
+	assert.Equal(t, `[{"id":0,"data":"0"},{"id":1,"data":"1"},{"id":2,"data":"2"}]`+"\n", rec.Body.String())
+
+	var events []jsonEvent
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	assert.Len(t, events, 3)
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, 0, s.SubscriberCount())
+}
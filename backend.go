@@ -0,0 +1,89 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "fmt"
+
+// LogBackend stores a streams eventlog, such as in a database, so that it
+// survives the process restarting and can be shared between processes, see
+// StreamConfig.LogBackend. Replays are served from the backend, while the
+// stream keeps its own copy for History, fingerprints and compaction. Its
+// methods are called from the streams run loop, and errors are passed to
+// the streams OnError. An *EventLog is an in memory LogBackend.
+//
+// Ids are given by the stream that logs each event, so only one process
+// should publish to a shared backend.
+type LogBackend interface {
+	// Append stores an event that has been logged, keeping the id the
+	// stream gave it
+	Append(e *Event) error
+	// ReplaySince returns the stored events with ids after id, oldest
+	// first
+	ReplaySince(id int) (EventLog, error)
+	// Truncate removes the stored events with the given ids, once they
+	// have been dropped from the eventlog or compacted away
+	Truncate(ids []int) error
+	// Len returns the number of stored events
+	Len() int
+}
+
+// loadBackend fills the eventlog from the streams backend, in place of its
+// seed, unless the backend is empty
+func (str *Stream) loadBackend() {
+	if str.backend.Len() == 0 {
+		return
+	}
+
+	events, err := str.backend.ReplaySince(-1)
+	if err != nil {
+		str.reportError(fmt.Errorf("broadcast: loading eventlog: %w", err))
+		return
+	}
+
+	str.seed = nil
+	setLogReq{events: events, keepIDs: true, restored: true, done: make(chan struct{})}.handle(str)
+}
+
+// storedLog returns the events after since to replay from the streams
+// backend, or its own eventlog if it has none or the backend fails. Events
+// at or before since may be included.
+func (str *Stream) storedLog(since int) EventLog {
+	if str.backend == nil {
+		return str.log
+	}
+
+	events, err := str.backend.ReplaySince(since)
+	if err != nil {
+		str.reportError(fmt.Errorf("broadcast: reading eventlog: %w", err))
+		return str.log
+	}
+	for i := range events {
+		events[i].logged = true
+	}
+	return events
+}
+
+// persist stores a logged event in the streams backend
+func (str *Stream) persist(e *Event) {
+	if str.backend == nil {
+		return
+	}
+
+	if err := str.backend.Append(e); err != nil {
+		str.reportError(fmt.Errorf("broadcast: storing event %d: %w", e.ID, err))
+	}
+}
+
+// truncateBackend removes events dropped from the eventlog from the
+// streams backend
+func (str *Stream) truncateBackend(ids []int) {
+	if str.backend == nil || len(ids) == 0 {
+		return
+	}
+
+	if err := str.backend.Truncate(ids); err != nil {
+		str.reportError(fmt.Errorf("broadcast: truncating eventlog: %w", err))
+	}
+}
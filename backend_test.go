@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLogBackend(t *testing.T) {
+	backend := &EventLog{}
+
+	s := newConfiguredStream(DefaultBufferSize, StreamConfig{
+		LogBackend: backend,
+		Seed: func() ([]*Event, error) {
+			return []*Event{{Data: []byte("seed")}}, nil
+		},
+	})
+	s.MaxLogSize = 3
+	s.run()
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, s.PublishSync(&Event{Data: []byte(strconv.Itoa(i))}))
+	}
+
+	// the seed is stored, then dropped along with the eventlog
+	assert.Equal(t, 3, backend.Len())
+	events, _ := backend.ReplaySince(-1)
+	assert.Equal(t, 1, events[0].ID)
+
+	s.close()
+	<-s.Done()
+
+	// a new stream resumes from the backend instead of its seed
+	s = newConfiguredStream(DefaultBufferSize, StreamConfig{
+		LogBackend: backend,
+		Seed: func() ([]*Event, error) {
+			t.Error("seed called for a stored eventlog")
+			return nil, nil
+		},
+	})
+	s.run()
+	defer s.close()
+
+	assert.Equal(t, []string{"1", "2", "3"}, historyData(s))
+
+	assert.Nil(t, s.PublishSync(&Event{Data: []byte("4")}))
+	events, _ = backend.ReplaySince(3)
+	assert.Len(t, events, 1)
+	assert.Equal(t, 4, events[0].ID)
+}
+
+func TestStreamLogBackendReplay(t *testing.T) {
+	backend := &EventLog{}
+
+	// the reader starts before anything is stored, so only has the events
+	// in the backend to replay
+	reader := newConfiguredStream(DefaultBufferSize, StreamConfig{LogBackend: backend})
+	reader.run()
+	defer reader.close()
+	reader.Stats()
+
+	writer := newConfiguredStream(DefaultBufferSize, StreamConfig{LogBackend: backend})
+	writer.KeyFunc = func(e *Event) string { return e.Event }
+	writer.run()
+	defer writer.close()
+
+	assert.Nil(t, writer.PublishSync(&Event{Event: "a", Data: []byte("1")}))
+	assert.Nil(t, writer.PublishSync(&Event{Event: "b", Data: []byte("2")}))
+	assert.Nil(t, writer.PublishSync(&Event{Event: "a", Data: []byte("3")}))
+
+	// compacted events are removed from the backend too
+	assert.Equal(t, 2, backend.Len())
+
+	sub := NewSubscriber("test")
+	reader.addSubscriber(sub)
+	c := sub.Connect()
+
+	assert.Equal(t, "2", string((<-c).Data))
+	assert.Equal(t, "3", string((<-c).Data))
+	assert.Len(t, reader.History(), 0)
+}
@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "time"
+
+// BackpressureAction is what a BackpressureStrategy does with an event that
+// a connection has no room for
+type BackpressureAction int
+
+const (
+	// BackpressureBlock waits until the connection has room, holding up
+	// delivery to every subscriber after it
+	BackpressureBlock BackpressureAction = iota
+	// BackpressureEnqueue queues the event on the connection, to be sent
+	// once it has room. The queue is not limited, other than by the
+	// subscribers SlowTimeout.
+	BackpressureEnqueue
+	// BackpressureDropNewest drops the event
+	BackpressureDropNewest
+	// BackpressureDropOldest drops the oldest event waiting on the
+	// connection to make room for the event
+	BackpressureDropOldest
+	// BackpressureDisconnect drops the event and closes the connection with
+	// ReasonSlowConsumer
+	BackpressureDisconnect
+)
+
+// BackpressureStrategy decides what happens to a live event that arrives
+// while one of a subscribers connections is full. OnFull is only called
+// when the connection has no room, from the goroutine delivering the event,
+// usually the streams run loop, while the subscriber is locked. It must be
+// quick and must not call back into the subscriber or stream.
+//
+// Replayed events are not passed to it, as replays wait for room.
+type BackpressureStrategy interface {
+	OnFull(sub *Subscriber, e *Event) BackpressureAction
+}
+
+// BackpressureFunc adapts a function to a BackpressureStrategy, such as one
+// that drops events based on their content
+type BackpressureFunc func(sub *Subscriber, e *Event) BackpressureAction
+
+// OnFull calls f
+func (f BackpressureFunc) OnFull(sub *Subscriber, e *Event) BackpressureAction {
+	return f(sub, e)
+}
+
+// fixedBackpressure always takes the same action
+type fixedBackpressure BackpressureAction
+
+func (a fixedBackpressure) OnFull(sub *Subscriber, e *Event) BackpressureAction {
+	return BackpressureAction(a)
+}
+
+// The standard strategies, which always take the same action
+var (
+	BlockStrategy      BackpressureStrategy = fixedBackpressure(BackpressureBlock)
+	EnqueueStrategy    BackpressureStrategy = fixedBackpressure(BackpressureEnqueue)
+	DropNewestStrategy BackpressureStrategy = fixedBackpressure(BackpressureDropNewest)
+	DropOldestStrategy BackpressureStrategy = fixedBackpressure(BackpressureDropOldest)
+	DisconnectStrategy BackpressureStrategy = fixedBackpressure(BackpressureDisconnect)
+)
+
+// backpressure returns the strategy for the connections subscriber, or nil
+func (c *Connection) backpressure() BackpressureStrategy {
+	if c.subscriber == nil {
+		return nil
+	}
+	if c.subscriber.options.Backpressure != nil {
+		return c.subscriber.options.Backpressure
+	}
+	return c.subscriber.backpressure
+}
+
+// deliverPressured delivers a live event, asking the strategy what to do if
+// the connection has no room for it
+func (c *Connection) deliverPressured(strategy BackpressureStrategy, e *Event) {
+	if c.conn == nil || c.duplicate(e) {
+		return
+	}
+
+	c.mu.Lock()
+	if len(c.backlog) == 0 {
+		select {
+		case c.conn <- e:
+			c.queued()
+			c.mu.Unlock()
+			return
+		default:
+		}
+	}
+	c.mu.Unlock()
+
+	switch strategy.OnFull(c.subscriber, e) {
+	case BackpressureEnqueue:
+		c.enqueue(e)
+	case BackpressureDropOldest:
+		c.mu.Lock()
+		if len(c.backlog) > 0 {
+			c.backlog[0] = nil
+			c.backlog = c.backlog[1:]
+		} else {
+			select {
+			case <-c.conn:
+			default:
+			}
+		}
+		c.mu.Unlock()
+		c.enqueue(e)
+	case BackpressureDropNewest:
+	case BackpressureDisconnect:
+		// the subscriber is locked while its events are delivered
+		go c.subscriber.disconnect(c, ReasonSlowConsumer)
+	default:
+		c.mu.Lock()
+		queued := len(c.backlog) > 0
+		c.mu.Unlock()
+
+		if queued {
+			// keep events queued by an earlier action in order
+			c.enqueue(e)
+			return
+		}
+
+		c.send(e)
+	}
+}
+
+// enqueue adds an event to the connections backlog, moving it onto the
+// connection as it makes room
+func (c *Connection) enqueue(e *Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.backlog = append(c.backlog, e)
+	c.flush()
+
+	if len(c.backlog) > 0 && !c.draining {
+		c.draining = true
+		go c.drainBacklog()
+	}
+}
+
+// drainBacklog moves the backlog onto the connection as it makes room,
+// until it is empty or the connection closes
+func (c *Connection) drainBacklog() {
+	t := time.NewTicker(replayPollInterval)
+	defer t.Stop()
+
+	for range t.C {
+		c.mu.Lock()
+		if !c.closed {
+			c.flush()
+		}
+		done := c.closed || len(c.backlog) == 0
+		if done {
+			c.draining = false
+		}
+		c.mu.Unlock()
+
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fill publishes more events than a connection holds without reading them,
+// then returns the events it received
+func fill(t *testing.T, strategy BackpressureStrategy, opts SubscriberOptions) []string {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.Backpressure = strategy
+
+	sub := NewSubscriberWithOptions("test", opts)
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 50)
+
+	for i := 0; i < 70; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	var ids []string
+	for {
+		select {
+		case e, ok := <-c:
+			if !ok {
+				return ids
+			}
+			ids = append(ids, string(e.Data))
+		case <-time.After(time.Millisecond * 100):
+			return ids
+		}
+	}
+}
+
+func TestStreamBackpressure(t *testing.T) {
+	ids := fill(t, DropNewestStrategy, SubscriberOptions{})
+	assert.Len(t, ids, 64)
+	assert.Equal(t, "63", ids[63])
+
+	ids = fill(t, DropOldestStrategy, SubscriberOptions{})
+	assert.Len(t, ids, 64)
+	assert.Equal(t, "6", ids[0])
+	assert.Equal(t, "69", ids[63])
+
+	ids = fill(t, EnqueueStrategy, SubscriberOptions{})
+	assert.Len(t, ids, 70)
+
+	ids = fill(t, DisconnectStrategy, SubscriberOptions{})
+	assert.Len(t, ids, 64)
+
+	// the subscribers own strategy takes precedence over the streams
+	evens := BackpressureFunc(func(sub *Subscriber, e *Event) BackpressureAction {
+		if n, _ := strconv.Atoi(string(e.Data)); n%2 == 0 {
+			return BackpressureEnqueue
+		}
+		return BackpressureDropNewest
+	})
+	ids = fill(t, DropNewestStrategy, SubscriberOptions{Backpressure: evens})
+	assert.Len(t, ids, 67)
+	assert.Equal(t, "68", ids[66])
+}
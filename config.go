@@ -0,0 +1,166 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"fmt"
+	"time"
+)
+
+// liveSettings are the settings connection writers use while they run
+type liveSettings struct {
+	RetryInterval time.Duration
+	KeepAlive     time.Duration
+	FlushInterval time.Duration
+	// closed once the settings change
+	changed chan struct{}
+}
+
+type reconfigureReq struct {
+	cfg  StreamConfig
+	done chan struct{}
+}
+
+// StreamConfig holds stream settings that are commonly shared between
+// streams, see Server.DefaultStreamConfig. Zero values leave the streams
+// own default in place.
+type StreamConfig struct {
+	// See Stream.RetryInterval
+	RetryInterval time.Duration
+	// See Stream.KeepAlive
+	KeepAlive time.Duration
+	// See Stream.MaxInactivity
+	MaxInactivity time.Duration
+	// See Stream.FlushInterval
+	FlushInterval time.Duration
+	// Loads the events a new stream starts its eventlog with, such as the
+	// current state from a database. It is called once from the streams
+	// run loop before any subscriber is served, and the events are given
+	// ids from 0. If it returns an error or panics, the stream starts with
+	// an empty eventlog and the error is passed to OnError.
+	Seed func() ([]*Event, error)
+	// See Stream.OnError
+	OnError func(err error)
+	// See Stream.ShutdownPriority
+	ShutdownPriority int
+	// See Stream.CatchUpCompleteEvent. Setting it in
+	// Server.DefaultStreamConfig enables it for every stream.
+	CatchUpCompleteEvent *Event
+	// Stores the eventlog outside of the process, such as in a database,
+	// and serves replays from it, see LogBackend. A new stream loads its
+	// eventlog from the backend, ahead of Seed, which is only called if the
+	// backend is empty. Streams of the same process each need a backend of
+	// their own, so it should be given to CreateStreamWithConfig rather
+	// than in Server.DefaultStreamConfig.
+	LogBackend LogBackend
+}
+
+// apply sets the streams settings to any that are set in cfg
+func (str *Stream) apply(cfg StreamConfig) {
+	if cfg.RetryInterval > 0 {
+		str.RetryInterval = cfg.RetryInterval
+	}
+	if cfg.KeepAlive > 0 {
+		str.KeepAlive = cfg.KeepAlive
+	}
+	if cfg.MaxInactivity > 0 {
+		str.MaxInactivity = cfg.MaxInactivity
+	}
+	if cfg.FlushInterval > 0 {
+		str.FlushInterval = cfg.FlushInterval
+	}
+	if cfg.ShutdownPriority != 0 {
+		str.ShutdownPriority = cfg.ShutdownPriority
+	}
+	if cfg.OnError != nil {
+		str.OnError = cfg.OnError
+	}
+	if cfg.CatchUpCompleteEvent != nil {
+		str.CatchUpCompleteEvent = cfg.CatchUpCompleteEvent
+	}
+	if cfg.Seed != nil {
+		str.seed = cfg.Seed
+	}
+	if cfg.LogBackend != nil {
+		str.backend = cfg.LogBackend
+	}
+}
+
+// Reconfigure applies the settings set in cfg to a running stream, without
+// disconnecting its subscribers. Zero values leave the current setting in
+// place. These settings take effect immediately:
+//   - KeepAlive and FlushInterval, for open connections as well as new ones
+//   - RetryInterval, which is sent to open connections when it changes
+//   - MaxInactivity, counting the time the stream has already been inactive
+//   - OnError
+//   - CatchUpCompleteEvent, for replays that complete afterwards
+//
+// Seed, ShutdownPriority and LogBackend only apply when a stream is
+// created, and are ignored. ErrStreamClosed is returned if the stream has closed.
+func (str *Stream) Reconfigure(cfg StreamConfig) error {
+	req := reconfigureReq{cfg: cfg, done: make(chan struct{})}
+
+	select {
+	case str.reconfigure <- req:
+	case <-str.done:
+		return ErrStreamClosed
+	}
+
+	<-req.done
+	return nil
+}
+
+// reconfigureLive applies new settings from the run loop, waking connection
+// writers to pick them up
+func (str *Stream) reconfigureLive(cfg StreamConfig) {
+	cfg.Seed = nil
+	cfg.ShutdownPriority = 0
+	cfg.LogBackend = nil
+
+	str.configMu.Lock()
+	str.apply(cfg)
+	changed := str.configChanged
+	str.configChanged = make(chan struct{})
+	str.configMu.Unlock()
+
+	close(changed)
+}
+
+// settings returns the settings connection writers use
+func (str *Stream) settings() liveSettings {
+	str.configMu.RLock()
+	defer str.configMu.RUnlock()
+
+	return liveSettings{
+		RetryInterval: str.RetryInterval,
+		KeepAlive:     str.KeepAlive,
+		FlushInterval: str.FlushInterval,
+		changed:       str.configChanged,
+	}
+}
+
+// seedLog fills the eventlog from the streams seed function
+func (str *Stream) seedLog() {
+	events, err := callSeed(str.seed)
+	str.seed = nil
+
+	if err != nil {
+		str.reportError(fmt.Errorf("broadcast: seeding stream: %w", err))
+		return
+	}
+
+	setLogReq{events: events, done: make(chan struct{})}.handle(str)
+}
+
+// callSeed calls seed, returning any panic as an error
+func callSeed(seed func() ([]*Event, error)) (events []*Event, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			events, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return seed()
+}
@@ -4,15 +4,396 @@
 
 package broadcast
 
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnectionTiming records how long a connection took to be established
+type ConnectionTiming struct {
+	// When the connection was made
+	RegisteredAt time.Time
+	// When the replay of the eventlog to the connection completed
+	ReplayDoneAt time.Time
+	// When the first live event was sent to the connection
+	FirstLiveAt time.Time
+}
+
+// ConnectionMetadata describes the client a connection was made for
+type ConnectionMetadata struct {
+	UserAgent  string
+	RemoteAddr string
+	// Headers of the request the connection was made for, when made by
+	// StreamHandler
+	Header http.Header
+	// Defaults to the time the connection was made
+	ConnectedAt time.Time
+}
+
 // Connection ..
 type Connection struct {
-	conn    chan *Event
-	eventid string
+	// unique id, assigned when the connection is made
+	id string
+	// Set when the connection is made, and not changed after
+	Metadata ConnectionMetadata
+	// IdleTimeout closes the connection if no events have been written to
+	// it for the given duration. A zero value never closes it.
+	IdleTimeout time.Duration
+	lastWrite   time.Time
+	subscriber  *Subscriber
+	conn        chan *Event
+	eventid     string
+	fingerprint string
+	// set until the connection has been replayed to, live events that
+	// arrive in the meantime are held in pending
+	replaying bool
+	pending   []*Event
+	encoder   Encoder
+	// signals the connections writer to flush any buffered events
+	flushNow chan struct{}
+	timing   ConnectionTiming
+	// called with the connections timing once it has been sent its first
+	// live event
+	onFirstLive func(c *Connection, t ConnectionTiming)
+	// buffered connections queue events that do not fit on the channel
+	// instead of blocking the sender
+	buffered  bool
+	backlog   []*Event
+	fullSince time.Time
+	closed    bool
+	// closed when the connection is closing, to release senders blocked on
+	// conn, which hold sendMu until they are done with it
+	stop   chan struct{}
+	sendMu sync.RWMutex
+	// set while a goroutine moves the backlog onto the connection
+	draining bool
+	// ids of recently delivered events, when duplicates are suppressed
+	dedup *idWindow
+	// id of the last event the connections writer sent to the client, or
+	// -1 before the first
+	sentID int
+	// when each of the last cap(conn) events was put on conn, indexed by
+	// their count modulo cap(conn)
+	queuedAt    []int64
+	queuedCount int
+	mu          sync.Mutex
+}
+
+// ID returns the connections unique id
+func (c *Connection) ID() string {
+	return c.id
+}
+
+// Subscriber returns the subscriber the connection belongs to
+func (c *Connection) Subscriber() *Subscriber {
+	return c.subscriber
+}
+
+// Send an event to a given subscriber connection. Events sent while the
+// connection is waiting for its replay are held until the replay completes.
+// It returns false if the connection has been closed.
+func (c *Connection) Send(e *Event) bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	if c.replaying {
+		c.pending = append(c.pending, e)
+		c.mu.Unlock()
+		return true
+	}
+	c.mu.Unlock()
+
+	c.deliverLive(e)
+	return true
+}
+
+// Timing returns when each stage of establishing the connection completed.
+// Stages that have not completed yet are zero.
+func (c *Connection) Timing() ConnectionTiming {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.timing
+}
+
+// deliverLive delivers a live event, recording the time of the first
+func (c *Connection) deliverLive(e *Event) {
+	c.mu.Lock()
+	first := c.timing.FirstLiveAt.IsZero()
+	if first {
+		c.timing.FirstLiveAt = time.Now()
+	}
+	timing, onFirstLive := c.timing, c.onFirstLive
+	c.mu.Unlock()
+
+	if strategy := c.backpressure(); strategy != nil {
+		c.deliverPressured(strategy, e)
+	} else {
+		c.deliver(e)
+	}
+
+	if first && onFirstLive != nil {
+		onFirstLive(c, timing)
+	}
+}
+
+// deliver an event to the connection, regardless of replay
+func (c *Connection) deliver(e *Event) {
+	if c.conn == nil || c.duplicate(e) {
+		return
+	}
+
+	if !c.buffered {
+		c.send(e)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.backlog = append(c.backlog, e)
+	c.flush()
+}
+
+// send waits for the connection to accept an event, returning false if it
+// is closed first
+func (c *Connection) send(e *Event) bool {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return false
+	}
+
+	select {
+	case c.conn <- e:
+	case <-c.stop:
+		return false
+	}
+
+	c.mu.Lock()
+	c.queued()
+	c.mu.Unlock()
+	return true
+}
+
+// close closes the connections channel, once any senders blocked on it
+// have given up, sending it a close event first if there is room for one
+func (c *Connection) close(closeEvent *Event) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	if c.stop != nil {
+		close(c.stop)
+	}
+	c.mu.Unlock()
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if closeEvent != nil {
+		select {
+		case c.conn <- closeEvent:
+		default:
+		}
+	}
+
+	close(c.conn)
+}
+
+// tryDeliver sends an event to the connection if it has room for it
+// without blocking. ok is false if it did not, and closed is true if it
+// never will as the connection has been closed.
+func (c *Connection) tryDeliver(e *Event) (ok, closed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false, true
+	}
+
+	if len(c.backlog) > 0 {
+		return false, false
+	}
+
+	if c.dedup != nil && e.hasID() && !c.dedup.add(e.ID) {
+		return true, false
+	}
+
+	select {
+	case c.conn <- e:
+		c.queued()
+		return true, false
+	default:
+		return false, false
+	}
+}
+
+// duplicate reports whether an event has already been delivered to the
+// connection, when it suppresses duplicates. Events without an id are
+// never duplicates.
+func (c *Connection) duplicate(e *Event) bool {
+	// dedup is only set when the connection is made
+	if c.dedup == nil || !e.hasID() {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.dedup.add(e.ID)
+}
+
+// drained reports whether the connections writer has taken every event
+// queued on it
+func (c *Connection) drained() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed || (len(c.conn) == 0 && len(c.backlog) == 0)
+}
+
+// flush moves as many queued events onto the connection as it will accept
+func (c *Connection) flush() {
+	for len(c.backlog) > 0 && !c.closed {
+		select {
+		case c.conn <- c.backlog[0]:
+			c.backlog[0] = nil
+			c.backlog = c.backlog[1:]
+			c.queued()
+		default:
+			if c.fullSince.IsZero() {
+				c.fullSince = time.Now()
+			}
+			return
+		}
+	}
+
+	c.fullSince = time.Time{}
+}
+
+// queued records that an event was put on the connections channel. c.mu
+// must be held.
+func (c *Connection) queued() {
+	now := time.Now()
+	c.lastWrite = now
+
+	if cap(c.conn) == 0 {
+		return
+	}
+	if c.queuedAt == nil {
+		c.queuedAt = make([]int64, cap(c.conn))
+	}
+	c.queuedAt[c.queuedCount%len(c.queuedAt)] = now.UnixNano()
+	c.queuedCount++
+}
+
+// queueDepth returns the number of events waiting to be taken by the
+// connections writer, and when the oldest of them was queued. Events held
+// for a replay are counted, but not aged, as they wait on the replay rather
+// than the client.
+func (c *Connection) queueDepth() (int, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.conn)
+	depth := n + len(c.backlog) + len(c.pending)
+
+	// the events on the channel are the last n queued, and the backlog is
+	// only moved onto it after them
+	var oldest time.Time
+	switch {
+	case n > 0 && c.queuedCount >= n:
+		oldest = time.Unix(0, c.queuedAt[(c.queuedCount-n)%len(c.queuedAt)])
+	case len(c.backlog) > 0:
+		oldest = c.fullSince
+	}
+
+	return depth, oldest
+}
+
+// stalled reports whether the connection has been unable to accept events
+// for longer than timeout
+func (c *Connection) stalled(timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flush()
+
+	return !c.fullSince.IsZero() && time.Since(c.fullSince) > timeout
+}
+
+// endReplay delivers the events that were held while the connection was
+// being replayed to, skipping any that the replay already included
+func (c *Connection) endReplay(lastID int) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.replaying = false
+	c.timing.ReplayDoneAt = time.Now()
+	c.mu.Unlock()
+
+	for i := range pending {
+		if pending[i].hasID() && pending[i].ID <= lastID {
+			continue
+		}
+		c.deliverLive(pending[i])
+	}
+}
+
+// sent records that the connections writer has sent an event to the client
+func (c *Connection) sent(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id > c.sentID {
+		c.sentID = id
+	}
+}
+
+// wants reports whether the connections subscriber accepts an event
+func (c *Connection) wants(e *Event) bool {
+	return c.subscriber == nil || c.subscriber.wants(e)
+}
+
+// isReplaying reports whether the connection is waiting for its replay to
+// complete
+func (c *Connection) isReplaying() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.replaying
+}
+
+// idle reports whether nothing has been written to the connection for
+// longer than its idle timeout
+func (c *Connection) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.IdleTimeout > 0 && time.Since(c.lastWrite) > c.IdleTimeout
 }
 
-// Send an event to a given subscriber connection
-func (c *Connection) Send(e *Event) {
-	if c.conn != nil {
-		c.conn <- e
+// signalFlush asks the connections writer to flush, if it is not already
+// due to
+func (c *Connection) signalFlush() {
+	select {
+	case c.flushNow <- struct{}{}:
+	default:
 	}
 }
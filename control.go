@@ -0,0 +1,430 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// controlRequest is a request that is answered from within a streams run
+// loop, so it has safe access to the streams internal state. Requests that
+// expect a result carry a buffered reply channel, which handle must send
+// exactly one value on. New kinds of query only need a type implementing
+// handle, and a method on Stream that sends it with control.
+type controlRequest interface {
+	handle(str *Stream)
+}
+
+// StreamStats is a snapshot of a streams state
+type StreamStats struct {
+	// Number of registered subscribers
+	Subscribers int
+	// Names of the registered subscribers that were given one
+	SubscriberNames []string
+	// Number of events held in the eventlog
+	LogSize int
+	// Number of events published over the lifetime of the stream,
+	// including those no longer held in the eventlog
+	TotalPublished uint64
+	// Whether the streams OverloadPolicy breaker has tripped
+	Overloaded bool
+	// Time left until the stream is closed for inactivity, if it has no
+	// active subscribers by then
+	UntilReap time.Duration
+	// Number of connections waiting to start a replay, see
+	// Stream.MaxConcurrentReplays
+	QueuedReplays int
+	// Number of events delayed or dropped by Stream.PublishRateLimit
+	Throttled uint64
+	// Number of chunked replays running, see Stream.ReplayChunkSize. Other
+	// replays complete within the run loop, so are never seen running.
+	ActiveReplays int
+	// Number of events queued on every connection that their writers have
+	// not taken yet, including live events held while a connection is
+	// replayed to
+	QueuedEvents int
+	// How long the oldest of the QueuedEvents has waited for its writer,
+	// from when it was put on its connection, or for events in a
+	// connections backlog, from when the connection filled. Events held
+	// for a replay are not included. Zero when nothing is queued.
+	OldestQueuedAge time.Duration
+}
+
+// SubscriberInfo is a snapshot of a subscriber registered on a stream
+type SubscriberInfo struct {
+	ID   string
+	Key  string
+	Name string
+	// Number of open connections
+	Connections int
+	// When the subscriber was registered on the stream
+	JoinedAt time.Time
+	// A copy of the subscribers SubscriberOptions.Metadata
+	Metadata map[string]string
+}
+
+// ConnectionInfo is a snapshot of one of a subscribers connections
+type ConnectionInfo struct {
+	SubscriberID string
+	ConnID       string
+	ConnectedAt  time.Time
+	// When an event was last delivered to the connection
+	LastWriteAt time.Time
+	RemoteAddr  string
+}
+
+type countReq struct {
+	reply chan int
+}
+
+func (r countReq) handle(str *Stream) {
+	r.reply <- len(str.subscribers)
+}
+
+type snapshotReq struct {
+	reply chan StreamStats
+}
+
+func (r snapshotReq) handle(str *Stream) {
+	b := str.backlog()
+
+	var names []string
+	for i := range str.subscribers {
+		if name := str.subscribers[i].Name(); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	r.reply <- StreamStats{
+		Subscribers:     len(str.subscribers),
+		SubscriberNames: names,
+		LogSize:         len(str.log),
+		TotalPublished:  str.totalPublished,
+		Overloaded:      str.breaker.tripped,
+		UntilReap:       str.MaxInactivity - time.Since(str.activeAt),
+		QueuedReplays:   int(atomic.LoadInt64(&str.queuedReplays)),
+		Throttled:       atomic.LoadUint64(&str.throttled),
+		ActiveReplays:   b.ActiveReplays,
+		QueuedEvents:    b.QueuedEvents,
+		OldestQueuedAge: b.OldestQueuedAge,
+	}
+}
+
+type subscriberIDsReq struct {
+	reply chan []string
+}
+
+func (r subscriberIDsReq) handle(str *Stream) {
+	ids := make([]string, len(str.subscribers))
+	for i := range str.subscribers {
+		ids[i] = str.subscribers[i].id
+	}
+	r.reply <- ids
+}
+
+type hasSubscriberReq struct {
+	id    string
+	reply chan bool
+}
+
+func (r hasSubscriberReq) handle(str *Stream) {
+	i, ok := str.subscriberIndex[r.id]
+	r.reply <- ok && str.subscribers[i].HasConnections()
+}
+
+type connectionsReq struct {
+	reply chan []ConnectionInfo
+}
+
+func (r connectionsReq) handle(str *Stream) {
+	var infos []ConnectionInfo
+	for i := range str.subscribers {
+		infos = append(infos, str.subscribers[i].connectionInfo()...)
+	}
+	r.reply <- infos
+}
+
+type subscribersReq struct {
+	reply chan []SubscriberInfo
+}
+
+func (r subscribersReq) handle(str *Stream) {
+	infos := make([]SubscriberInfo, len(str.subscribers))
+	for i := range str.subscribers {
+		infos[i] = str.subscribers[i].info()
+	}
+	r.reply <- infos
+}
+
+type historyReq struct {
+	reply chan EventLog
+}
+
+func (r historyReq) handle(str *Stream) {
+	r.reply <- str.log.Copy()
+}
+
+type fingerprintReq struct {
+	reply chan string
+}
+
+func (r fingerprintReq) handle(str *Stream) {
+	r.reply <- str.fingerprint()
+}
+
+// detachReq removes every subscriber from the stream and returns them,
+// leaving their connections open
+type detachReq struct {
+	reply chan []*Subscriber
+}
+
+func (r detachReq) handle(str *Stream) {
+	subscribers := str.subscribers
+	str.releaseSubscribers(len(subscribers))
+	str.subscribers = make([]*Subscriber, 0)
+	str.subscriberIndex = make(map[string]int)
+	str.subscribersChanged()
+
+	for i := range subscribers {
+		subscribers[i].unwatch()
+	}
+
+	r.reply <- subscribers
+}
+
+// closeConnReq closes one of a subscribers connections, deregistering the
+// subscriber if it was its last
+type closeConnReq struct {
+	subscriberID string
+	connID       string
+	reason       DisconnectReason
+	reply        chan error
+}
+
+func (r closeConnReq) handle(str *Stream) {
+	i, ok := str.subscriberIndex[r.subscriberID]
+	if !ok {
+		r.reply <- ErrSubscriberNotFound
+		return
+	}
+
+	sub := str.subscribers[i]
+	c := sub.connection(r.connID)
+	if c == nil {
+		r.reply <- ErrConnectionNotFound
+		return
+	}
+
+	if sub.ConnectionCount() == 1 {
+		str.removeSubscriber(i, r.reason)
+	} else {
+		sub.disconnect(c, r.reason)
+	}
+
+	r.reply <- nil
+}
+
+// setLogReq replaces the eventlog with the given events
+type setLogReq struct {
+	events EventLog
+	// keep the ids the events already have, see ImportStream
+	keepIDs bool
+	// with keepIDs, the id the next event published is given, if later
+	// than the last kept id
+	nextID int
+	// the events were loaded from the streams backend, so are not written
+	// back to it
+	restored bool
+	done     chan struct{}
+}
+
+func (r setLogReq) handle(str *Stream) {
+	delta := -str.logBytes
+	if !r.restored {
+		ids := make([]int, len(str.log))
+		for i := range str.log {
+			ids[i] = str.log[i].ID
+		}
+		str.truncateBackend(ids)
+	}
+
+	// new ids continue after every event logged so far, so none is reused
+	last := str.nextID() - 1
+
+	str.log = make(EventLog, 0, len(r.events))
+	str.logHash = 0
+	str.logBytes = 0
+	str.keyedIDs = nil
+	str.logKeys = nil
+
+	for i := range r.events {
+		e := r.events[i]
+		if !r.keepIDs {
+			// the callers events may still be on their way to connections
+			e = e.copy()
+			e.ID = last + i + 1
+		}
+		e.logged = true
+		str.log = append(str.log, e)
+		str.logHash ^= e.hash()
+		if str.KeyFunc != nil {
+			str.indexKey(e.ID, str.KeyFunc(e))
+		}
+		if !r.restored {
+			str.persist(e)
+		}
+		if str.CompressLog {
+			str.log[i] = e.compressed()
+		}
+		str.logBytes += len(str.log[i].Data)
+	}
+
+	// the replaced events, or those before the first kept id, were evicted
+	// as far as replay is concerned
+	str.evictedID = last
+	if r.keepIDs {
+		str.evictedID = -1
+		if len(str.log) > 0 {
+			str.evictedID = str.log[0].ID - 1
+		}
+		// events after the last kept id were evicted before the export
+		if r.nextID > str.nextID() {
+			str.evictedID = r.nextID - 1
+		}
+	}
+
+	delta += str.logBytes
+	if str.onLogResize != nil && delta != 0 {
+		str.onLogResize(delta)
+	}
+
+	close(r.done)
+}
+
+// dropSubscribersReq disconnects every subscriber on the stream
+type dropSubscribersReq struct {
+	reason DisconnectReason
+}
+
+func (r dropSubscribersReq) handle(str *Stream) {
+	str.removeAllSubscribers(r.reason)
+}
+
+type flushReq struct{}
+
+func (r flushReq) handle(str *Stream) {
+	for i := range str.subscribers {
+		str.subscribers[i].flush()
+	}
+}
+
+// control sends a request to the run loop, returning false if the stream
+// has been closed and the request will not be handled. Requests do not
+// count as activity, so polling a stream does not stop it being closed
+// after MaxInactivity.
+func (str *Stream) control(req controlRequest) bool {
+	select {
+	case str.ctrl <- req:
+		return true
+	case <-str.done:
+		return false
+	}
+}
+
+// SubscriberCount returns the number of subscribers registered on the stream
+func (str *Stream) SubscriberCount() int {
+	reply := make(chan int, 1)
+	if !str.control(countReq{reply: reply}) {
+		return 0
+	}
+	return <-reply
+}
+
+// Stats returns a snapshot of the streams state
+func (str *Stream) Stats() StreamStats {
+	stats, _ := str.stats()
+	return stats
+}
+
+// stats returns a snapshot of the streams state, or false if the stream
+// has closed
+func (str *Stream) stats() (StreamStats, bool) {
+	reply := make(chan StreamStats, 1)
+	if !str.control(snapshotReq{reply: reply}) {
+		return StreamStats{}, false
+	}
+	return <-reply, true
+}
+
+// SubscriberIDs returns the ids of all subscribers registered on the stream
+func (str *Stream) SubscriberIDs() []string {
+	reply := make(chan []string, 1)
+	if !str.control(subscriberIDsReq{reply: reply}) {
+		return nil
+	}
+	return <-reply
+}
+
+// HasSubscriber reports whether the subscriber with the given id is
+// registered on the stream and has at least one open connection
+func (str *Stream) HasSubscriber(id string) bool {
+	reply := make(chan bool, 1)
+	if !str.control(hasSubscriberReq{id: id, reply: reply}) {
+		return false
+	}
+	return <-reply
+}
+
+// Subscribers returns a snapshot of every subscriber registered on the
+// stream. The snapshot is a copy, so is safe to keep and modify.
+func (str *Stream) Subscribers() []SubscriberInfo {
+	reply := make(chan []SubscriberInfo, 1)
+	if !str.control(subscribersReq{reply: reply}) {
+		return nil
+	}
+	return <-reply
+}
+
+// Connections returns a snapshot of every open connection on the stream,
+// for finding ones that have been idle too long to close with
+// CloseConnection
+func (str *Stream) Connections() []ConnectionInfo {
+	reply := make(chan []ConnectionInfo, 1)
+	if !str.control(connectionsReq{reply: reply}) {
+		return nil
+	}
+	return <-reply
+}
+
+// CloseConnection closes a single connection of the subscriber with the
+// given id, sending it a close event with the reason if the stream emits
+// them, see EmitCloseEvents. If it is the subscribers last connection, the
+// subscriber is also removed from the stream.
+func (str *Stream) CloseConnection(subscriberID, connID string, reason DisconnectReason) error {
+	reply := make(chan error, 1)
+	if !str.control(closeConnReq{subscriberID: subscriberID, connID: connID, reason: reason, reply: reply}) {
+		return ErrStreamClosed
+	}
+	return <-reply
+}
+
+// ResetLog clears the streams eventlog, so new connections are not replayed
+// any events until more are published. Event ids continue from the last
+// event logged, and clients reconnecting with an earlier id are replayed
+// the whole eventlog.
+func (str *Stream) ResetLog() {
+	str.SetLog(nil)
+}
+
+// SetLog replaces the streams eventlog with copies of the given events,
+// which are assigned new ids continuing from the last event logged. The
+// given events are left unchanged.
+func (str *Stream) SetLog(events []*Event) {
+	done := make(chan struct{})
+	if str.control(setLogReq{events: events, done: done}) {
+		<-done
+	}
+}
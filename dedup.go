@@ -0,0 +1,40 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+// idWindow remembers the last size event ids added to it, so duplicates can
+// be found in constant time
+type idWindow struct {
+	seen map[int]struct{}
+	// ids in the order they were added, oldest at next once full
+	ids  []int
+	next int
+}
+
+func newIDWindow(size int) *idWindow {
+	return &idWindow{
+		seen: make(map[int]struct{}, size),
+		ids:  make([]int, 0, size),
+	}
+}
+
+// add records an id, returning false if it is already in the window
+func (w *idWindow) add(id int) bool {
+	if _, ok := w.seen[id]; ok {
+		return false
+	}
+
+	if len(w.ids) < cap(w.ids) {
+		w.ids = append(w.ids, id)
+	} else {
+		delete(w.seen, w.ids[w.next])
+		w.ids[w.next] = id
+		w.next = (w.next + 1) % len(w.ids)
+	}
+
+	w.seen[id] = struct{}{}
+
+	return true
+}
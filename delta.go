@@ -0,0 +1,57 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+// replayLog returns the events to replay to new connections, which include
+// at least those after since. When the stream has ApplyDelta set, each
+// logged delta is applied to the event before it with the same key, so
+// every base event and the deltas after it are replayed as a single event
+// holding the resulting state.
+func (str *Stream) replayLog(since int) EventLog {
+	if str.ApplyDelta == nil {
+		return str.storedLog(since)
+	}
+
+	// deltas need the events they build on
+	log := str.storedLog(-1)
+	events := make(EventLog, 0, len(log))
+	// position in events of the latest state for each key
+	latest := make(map[string]int)
+
+	for _, ev := range log {
+		ev = ev.decompressed()
+
+		var key string
+		if str.KeyFunc != nil {
+			key = str.KeyFunc(ev)
+		}
+
+		i, ok := latest[key]
+		if ev.Delta && ok {
+			state, err := str.ApplyDelta(events[i], ev)
+			if err == nil && state != nil {
+				// the state replaces its base, and takes the deltas place
+				// in the eventlog so ids stay in order
+				state.ID = ev.ID
+				state.logged = true
+				events[i] = nil
+				ev = state
+			}
+		}
+
+		latest[key] = len(events)
+		events = append(events, ev)
+	}
+
+	// drop the bases that were replaced
+	out := events[:0]
+	for _, ev := range events {
+		if ev != nil {
+			out = append(out, ev)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,49 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "encoding/json"
+
+// CloseEvent is the name of the event sent to a connection before the
+// server closes it, see Stream.EmitCloseEvents
+const CloseEvent = "_close"
+
+// DisconnectReason explains to a client why the server closed its
+// connection, so it can decide whether to reconnect
+type DisconnectReason string
+
+const (
+	// ReasonNone closes connections without sending a close event
+	ReasonNone DisconnectReason = ""
+	// ReasonShutdown is sent when the stream or server is closed. Clients
+	// should reconnect.
+	ReasonShutdown DisconnectReason = "server_shutdown"
+	// ReasonDraining is sent when a subscriber could not be moved to a
+	// draining stream. Clients should reconnect, ideally to another server.
+	ReasonDraining DisconnectReason = "draining"
+	// ReasonSlowConsumer is sent when a subscriber is evicted for not
+	// keeping up. Clients should back off before reconnecting.
+	ReasonSlowConsumer DisconnectReason = "slow_consumer"
+	// ReasonIdle is sent when a connection exceeds its idle timeout
+	ReasonIdle DisconnectReason = "idle_timeout"
+	// ReasonInactive is sent when the stream is closed after its
+	// MaxInactivity. Clients can reconnect once there is activity again.
+	ReasonInactive DisconnectReason = "stream_inactive"
+	// ReasonSuperseded is sent when an Exclusive subscriber with the same
+	// key replaces the clients subscriber. Clients should not reconnect.
+	ReasonSuperseded DisconnectReason = "superseded"
+	// ReasonAuthRevoked tells clients they are no longer allowed to
+	// subscribe. Clients should not reconnect.
+	ReasonAuthRevoked DisconnectReason = "auth_revoked"
+)
+
+// event returns the close event sent for the reason
+func (r DisconnectReason) event() *Event {
+	data, _ := json.Marshal(struct {
+		Reason DisconnectReason `json:"reason"`
+	}{r})
+
+	return &Event{Event: CloseEvent, Data: data}
+}
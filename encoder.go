@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Encoder serializes the data of an event for a connection
+type Encoder interface {
+	Encode(e *Event) ([]byte, error)
+}
+
+// EncoderFunc allows a function to be used as an Encoder
+type EncoderFunc func(e *Event) ([]byte, error)
+
+// Encode calls f(e)
+func (f EncoderFunc) Encode(e *Event) ([]byte, error) {
+	return f(e)
+}
+
+// EncodeErrorAction decides what happens to an event that a connections
+// encoder failed to serialize
+type EncodeErrorAction int
+
+const (
+	// EncodeErrorSkip skips the event for the connection that failed to
+	// encode it, and continues sending it to every other connection
+	EncodeErrorSkip EncodeErrorAction = iota
+	// EncodeErrorDrop drops the event for every connection that has not
+	// written it yet
+	EncodeErrorDrop
+	// EncodeErrorDisconnect closes the connection that failed to encode it
+	EncodeErrorDisconnect
+)
+
+// JSONEncoder marshals an events payload as json. Events without a
+// payload are sent using their raw data.
+var JSONEncoder Encoder = EncoderFunc(func(e *Event) ([]byte, error) {
+	if e.Payload == nil {
+		return e.Data, nil
+	}
+	return json.Marshal(e.Payload)
+})
+
+// negotiateEncoder returns the first of the streams encoders that matches a
+// media type listed in an Accept header, or the JSONEncoder if none match
+func (str *Stream) negotiateEncoder(accept string) Encoder {
+	for _, mt := range strings.Split(accept, ",") {
+		if i := strings.Index(mt, ";"); i != -1 {
+			mt = mt[:i]
+		}
+
+		if enc, ok := str.Encoders[strings.TrimSpace(mt)]; ok {
+			return enc
+		}
+	}
+
+	return JSONEncoder
+}
@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"errors"
+)
+
+// ErrSlowConsumer is reported when a subscriber is evicted because its
+// connections stopped accepting events for longer than its slow timeout
+var ErrSlowConsumer = errors.New("broadcast: subscriber evicted as a slow consumer")
+
+// ErrStreamDraining is returned when subscribing to a stream that is draining
+var ErrStreamDraining = errors.New("broadcast: stream is draining")
+
+// ErrStreamClosed is returned when using a stream that has been closed
+var ErrStreamClosed = errors.New("broadcast: stream is closed")
+
+// ErrStreamNotFound is returned when a stream does not exist
+var ErrStreamNotFound = errors.New("broadcast: stream not found")
+
+// ErrSubscriberNotFound is returned when a subscriber is not registered on
+// a stream
+var ErrSubscriberNotFound = errors.New("broadcast: subscriber not found")
+
+// ErrConnectionNotFound is returned when a subscriber has no connection
+// with a given id
+var ErrConnectionNotFound = errors.New("broadcast: connection not found")
+
+// ErrInvalidAlias is returned when adding an alias that would hide a stream
+// or refer to itself
+var ErrInvalidAlias = errors.New("broadcast: invalid stream alias")
+
+// ErrTooManySubscribers is returned when subscribing would exceed a servers
+// MaxTotalSubscribers
+var ErrTooManySubscribers = errors.New("broadcast: too many subscribers")
+
+// ErrEventShed is returned when an event is dropped by a streams
+// OverloadPolicy
+var ErrEventShed = errors.New("broadcast: event shed by overload policy")
+
+// ErrRateLimited is returned when an event is dropped by a streams
+// PublishRateLimit
+var ErrRateLimited = errors.New("broadcast: publish rate limit exceeded")
+
+// ErrEventTooLarge is returned when an event is larger than a streams
+// MaxEventSize
+var ErrEventTooLarge = errors.New("broadcast: event exceeds maximum size")
+
+// ErrInvalidEventID is returned when a Last-Event-ID is not one written by
+// the streams EventIDs
+var ErrInvalidEventID = errors.New("broadcast: invalid event id")
+
+// ErrForeignEventID is returned when a Last-Event-ID belongs to another
+// stream
+var ErrForeignEventID = errors.New("broadcast: event id belongs to another stream")
+
+// ErrInvalidExport is returned when importing data that was not produced by
+// Stream.Export
+var ErrInvalidExport = errors.New("broadcast: invalid stream export")
+
+// ErrStreamUnresponsive is returned by health checks when a streams run
+// loop does not answer in time
+var ErrStreamUnresponsive = errors.New("broadcast: stream is unresponsive")
+
+// ErrStreamSaturated is returned by health checks when a streams event
+// buffer has been full for too long
+var ErrStreamSaturated = errors.New("broadcast: stream buffer is saturated")
+
+// SubscriberError is an error that relates to a specific subscriber
+type SubscriberError struct {
+	SubscriberID string
+	// The subscribers name, if it was given one
+	SubscriberName string
+	Err            error
+}
+
+func (e *SubscriberError) Error() string {
+	if e.SubscriberName != "" {
+		return e.Err.Error() + ": " + e.SubscriberID + " (" + e.SubscriberName + ")"
+	}
+	return e.Err.Error() + ": " + e.SubscriberID
+}
+
+// Unwrap returns the underlying error
+func (e *SubscriberError) Unwrap() error {
+	return e.Err
+}
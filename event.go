@@ -4,8 +4,207 @@
 
 package broadcast
 
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
 // Event stores the id and data of an associated event
 type Event struct {
-	ID   int
-	Data []byte
+	ID int
+	// Optional event type, sent as the sse event field
+	Event string
+	Data  []byte
+	// Optional structured value, serialized by each connections encoder.
+	// When nil, Data is sent as is.
+	Payload interface{}
+	// Time the event was received by the stream
+	Timestamp time.Time
+	// How long after its timestamp the event is still replayed to new
+	// connections. Zero replays it for as long as it is in the eventlog.
+	// Live delivery is unaffected.
+	MaxAge time.Duration
+	// Optional version of the events schema, used to convert it for
+	// subscribers that only accept earlier versions, see Stream.Downgrades
+	Version int
+	// Marks the event as a partial update to the event before it with the
+	// same key, see Stream.ApplyDelta
+	Delta bool
+	// Extra fields written to the sse output in key order, after the
+	// standard fields. Fields named after a standard field are ignored.
+	Fields map[string]string
+	// when set, the event is only sent to subscribers it matches
+	match func(*Subscriber) bool
+	// when the stream handled the event, recorded with MeasureLatency
+	received time.Time
+	// receives the result of handling the event, for PublishSync
+	sync chan error
+	// events published together with PublishBatch, carried by an event
+	// that is not itself delivered
+	batch []*Event
+	// set once the event has been dropped for every connection, see
+	// EncodeErrorDrop
+	dropped int32
+	// set on eventlog copies whose Data is gzipped, see Stream.CompressLog,
+	// along with the hash of the original event
+	gzipped bool
+	sum     uint64
+	// set once the eventlog has given the event its id. Ids start at 0, so
+	// the first event logged is told apart from unlogged events by this.
+	logged bool
+	// set on the copy of the streams CatchUpCompleteEvent each connection
+	// is sent
+	catchUp bool
+}
+
+// Size returns the number of bytes the event takes up when written to a
+// client with the default encoding and framing, including its id, event
+// type, extra fields and each line of its data. Timestamps and queue waits
+// are not counted, as they depend on the stream.
+func (e *Event) Size() int {
+	var n int
+
+	if e.hasID() {
+		n += len("id: \n") + len(strconv.Itoa(e.ID))
+	}
+
+	if e.Event != "" {
+		n += len("event: \n") + len(e.Event)
+	}
+
+	for _, name := range extraFieldNames(e.Fields, "") {
+		n += len(": \n") + len(name) + len(e.Fields[name])
+	}
+
+	for _, line := range bytes.Split(e.Data, []byte("\n")) {
+		n += len("data: \n") + len(bytes.TrimSuffix(line, []byte("\r")))
+	}
+
+	return n + len("\n")
+}
+
+// hasID reports whether the event has an id to send to clients, because it
+// was logged or given one by the publisher
+func (e *Event) hasID() bool {
+	return e.ID > 0 || e.logged
+}
+
+// complete reports the result of handling the event to PublishSync
+func (e *Event) complete(err error) {
+	if e.sync != nil {
+		e.sync <- err
+		e.sync = nil
+	}
+}
+
+// expired reports whether the event is too old to be replayed
+func (e *Event) expired(now time.Time) bool {
+	return e.MaxAge > 0 && now.After(e.Timestamp.Add(e.MaxAge))
+}
+
+func (e *Event) drop() {
+	atomic.StoreInt32(&e.dropped, 1)
+}
+
+func (e *Event) isDropped() bool {
+	return atomic.LoadInt32(&e.dropped) == 1
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// hash returns an fnv-1a hash of the events id and data. It is computed
+// inline as it runs for every logged event.
+func (e *Event) hash() uint64 {
+	if e.gzipped {
+		return e.sum
+	}
+
+	h := uint64(fnvOffset64)
+
+	id := uint64(e.ID)
+	for i := 0; i < 8; i++ {
+		h ^= id & 0xff
+		h *= fnvPrime64
+		id >>= 8
+	}
+
+	for _, b := range e.Data {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+
+	return h
+}
+
+// copy returns a copy of the event, without any of the state the stream
+// attaches to it while handling it
+func (e *Event) copy() *Event {
+	return &Event{
+		ID:        e.ID,
+		Event:     e.Event,
+		Data:      e.Data,
+		Payload:   e.Payload,
+		Timestamp: e.Timestamp,
+		MaxAge:    e.MaxAge,
+		Version:   e.Version,
+		Delta:     e.Delta,
+		Fields:    e.Fields,
+		logged:    e.logged,
+	}
+}
+
+// compressed returns a copy of the event with its data gzipped, for keeping
+// in the eventlog
+func (e *Event) compressed() *Event {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(e.Data)
+	gz.Close()
+
+	return &Event{
+		ID:        e.ID,
+		Event:     e.Event,
+		Data:      buf.Bytes(),
+		Payload:   e.Payload,
+		Timestamp: e.Timestamp,
+		MaxAge:    e.MaxAge,
+		Version:   e.Version,
+		Delta:     e.Delta,
+		Fields:    e.Fields,
+		logged:    e.logged,
+		gzipped:   true,
+		sum:       e.hash(),
+	}
+}
+
+// decompressed returns a copy of a compressed event with its original
+// data, or the event itself if it is not compressed
+func (e *Event) decompressed() *Event {
+	if !e.gzipped {
+		return e
+	}
+
+	var buf bytes.Buffer
+	if gz, err := gzip.NewReader(bytes.NewReader(e.Data)); err == nil {
+		buf.ReadFrom(gz)
+	}
+
+	return &Event{
+		ID:        e.ID,
+		Event:     e.Event,
+		Data:      buf.Bytes(),
+		Payload:   e.Payload,
+		Timestamp: e.Timestamp,
+		MaxAge:    e.MaxAge,
+		Version:   e.Version,
+		Delta:     e.Delta,
+		Fields:    e.Fields,
+		logged:    e.logged,
+	}
 }
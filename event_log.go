@@ -6,33 +6,149 @@ package broadcast
 
 import (
 	"strconv"
+	"time"
 )
 
 // EventLog holds all of previous events
 type EventLog []*Event
 
-// Add event to eventlog
+// Add event to eventlog, giving it the next id
 func (e *EventLog) Add(ev *Event) {
-	ev.ID = e.currentindex()
+	ev.ID = e.nextid()
+	ev.logged = true
 	(*e) = append((*e), ev)
 }
 
+// Append adds an event to the eventlog as it is, keeping its id, so that
+// an EventLog can be used as a LogBackend
+func (e *EventLog) Append(ev *Event) error {
+	(*e) = append((*e), ev)
+	return nil
+}
+
+// ReplaySince returns the events with ids after id
+func (e *EventLog) ReplaySince(id int) (EventLog, error) {
+	return e.After(id), nil
+}
+
+// Truncate removes the events with the given ids
+func (e *EventLog) Truncate(ids []int) error {
+	remove := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	events := (*e)[:0]
+	for _, ev := range *e {
+		if !remove[ev.ID] {
+			events = append(events, ev)
+		}
+	}
+	for i := len(events); i < len((*e)); i++ {
+		(*e)[i] = nil
+	}
+	(*e) = events
+
+	return nil
+}
+
+// Len returns the number of events in the eventlog
+func (e *EventLog) Len() int {
+	return len((*e))
+}
+
 // Clear events from eventlog
 func (e *EventLog) Clear() {
 	*e = nil
 }
 
-// Replay events to a subscriber
-func (e *EventLog) Replay(c *Connection) {
+// ReplayOrder is the order the eventlog is replayed to connections in
+type ReplayOrder int
+
+const (
+	// Ascending replays the oldest events first
+	Ascending ReplayOrder = iota
+	// Descending replays the newest events first
+	Descending
+)
+
+// Replay events to a subscriber, returning the number of events sent
+func (e *EventLog) Replay(c *Connection) int {
+	sent, _ := e.replay(c, Ascending)
+	return sent
+}
+
+// replay returns the number of events sent and the id of the newest one.
+// Events that have passed their MaxAge, or that the connections subscriber
+// filters out, are skipped.
+func (e *EventLog) replay(c *Connection, order ReplayOrder) (int, int) {
+	sent, last := 0, -1
+	now := time.Now()
+	evid, _ := strconv.Atoi(c.eventid)
+
 	for i := 0; i < len((*e)); i++ {
-		evid, _ := strconv.Atoi(c.eventid)
+		ev := (*e)[i]
+		if order == Descending {
+			ev = (*e)[len((*e))-1-i]
+		}
+
+		if ev.ID < evid {
+			continue
+		}
 
-		if (*e)[i].ID >= evid {
-			c.Send((*e)[i])
+		ev = ev.decompressed()
+		if ev.expired(now) || !c.wants(ev) {
+			continue
+		}
+
+		if ev = c.versioned(ev); ev != nil {
+			c.deliver(ev)
+			sent++
+			if ev.ID > last {
+				last = ev.ID
+			}
 		}
 	}
+
+	return sent, last
 }
 
-func (e *EventLog) currentindex() int {
-	return len((*e))
+// After returns all events that were added after a given event id
+func (e *EventLog) After(id int) EventLog {
+	events := make(EventLog, 0)
+
+	for i := 0; i < len((*e)); i++ {
+		if (*e)[i].ID > id {
+			events = append(events, (*e)[i].decompressed())
+		}
+	}
+
+	return events
+}
+
+// reverse returns a copy of the eventlog with the newest events first
+func (e *EventLog) reverse() EventLog {
+	events := make(EventLog, len((*e)))
+	for i := range *e {
+		events[len(events)-1-i] = (*e)[i]
+	}
+	return events
+}
+
+// Copy returns a copy of the eventlog
+func (e *EventLog) Copy() EventLog {
+	events := make(EventLog, len((*e)))
+	for i := range *e {
+		events[i] = (*e)[i].decompressed()
+	}
+	return events
+}
+
+// nextid returns the id for the next event added to the log, continuing
+// from the newest event
+func (e *EventLog) nextid() int {
+	if len((*e)) == 0 {
+		return 0
+	}
+	return (*e)[len((*e))-1].ID + 1
 }
@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"strings"
+)
+
+// IDGenerator writes event ids that carry the id of their stream as well as
+// their sequence, in the form <streamID>-<seq>. Clients reconnecting with a
+// Last-Event-ID from another stream can then be rejected, rather than being
+// replayed from an unrelated position.
+type IDGenerator struct {
+	StreamID string
+}
+
+// NewIDGenerator creates an IDGenerator for a stream
+func NewIDGenerator(streamID string) *IDGenerator {
+	return &IDGenerator{StreamID: streamID}
+}
+
+// Format returns the id for the event with the given sequence
+func (g *IDGenerator) Format(seq int) string {
+	return g.StreamID + "-" + strconv.Itoa(seq)
+}
+
+// Parse returns the sequence held by an id. It returns ErrInvalidEventID if
+// the id is malformed, or ErrForeignEventID if it belongs to another stream.
+func (g *IDGenerator) Parse(id string) (int, error) {
+	if rest := strings.TrimPrefix(id, g.StreamID+"-"); rest != id {
+		seq, err := strconv.Atoi(rest)
+		if err != nil || seq < 0 {
+			return 0, ErrInvalidEventID
+		}
+		return seq, nil
+	}
+
+	// well formed ids from other streams
+	i := strings.LastIndex(id, "-")
+	if i > 0 {
+		if seq, err := strconv.Atoi(id[i+1:]); err == nil && seq >= 0 {
+			return 0, ErrForeignEventID
+		}
+	}
+
+	return 0, ErrInvalidEventID
+}
+
+// Validate parses a clients Last-Event-ID, returning its sequence. It can be
+// used as a Stream.ValidateLastEventID, which it is by default for streams
+// with EventIDs.
+func (g *IDGenerator) Validate(id string) (string, error) {
+	seq, err := g.Parse(id)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(seq), nil
+}
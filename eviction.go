@@ -0,0 +1,168 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LogUsage describes how much memory a streams eventlog is using
+type LogUsage struct {
+	// Total size of the logged events data in bytes
+	Bytes int
+	// Number of logged events
+	Events int
+	// Timestamp of the oldest logged event
+	Oldest time.Time
+}
+
+// EvictionPolicy chooses which stream should drop events from its eventlog
+// when a servers logs exceed its MaxTotalLogBytes budget
+type EvictionPolicy interface {
+	// Choose is passed the usage of every stream with events that can be
+	// evicted, and returns the id of the stream to evict from. Returning
+	// an empty id stops eviction.
+	Choose(usage map[string]LogUsage) string
+}
+
+// EvictionPolicyFunc allows a function to be used as an EvictionPolicy
+type EvictionPolicyFunc func(usage map[string]LogUsage) string
+
+// Choose calls f(usage)
+func (f EvictionPolicyFunc) Choose(usage map[string]LogUsage) string {
+	return f(usage)
+}
+
+// EvictLargestLog evicts from the stream whose eventlog uses the most bytes
+var EvictLargestLog EvictionPolicy = EvictionPolicyFunc(func(usage map[string]LogUsage) string {
+	var id string
+	var largest int
+
+	for sid, u := range usage {
+		if u.Bytes > largest {
+			id, largest = sid, u.Bytes
+		}
+	}
+
+	return id
+})
+
+// EvictOldestEvent evicts from the stream holding the oldest logged event
+var EvictOldestEvent EvictionPolicy = EvictionPolicyFunc(func(usage map[string]LogUsage) string {
+	var id string
+	var oldest time.Time
+
+	for sid, u := range usage {
+		if id == "" || u.Oldest.Before(oldest) {
+			id, oldest = sid, u.Oldest
+		}
+	}
+
+	return id
+})
+
+type logUsageReq struct {
+	reply chan LogUsage
+}
+
+func (r logUsageReq) handle(str *Stream) {
+	u := LogUsage{
+		Bytes:  str.logBytes,
+		Events: len(str.log),
+	}
+
+	if len(str.log) > 0 {
+		u.Oldest = str.log[0].Timestamp
+	}
+
+	r.reply <- u
+}
+
+// dropLogReq removes the oldest events from a streams eventlog until at
+// least the given number of bytes have been freed
+type dropLogReq struct {
+	bytes int
+	reply chan int
+}
+
+func (r dropLogReq) handle(str *Stream) {
+	r.reply <- str.dropOldest(r.bytes)
+}
+
+// resizeLog is called by a servers streams when the size of their log changes
+func (s *Server) resizeLog(delta int) {
+	if atomic.AddInt64(&s.logBytes, int64(delta)) <= s.MaxTotalLogBytes || s.MaxTotalLogBytes <= 0 {
+		return
+	}
+
+	s.evictOnce.Do(func() {
+		s.evictSignal = make(chan struct{}, 1)
+		go s.evictLogs(s.evictSignal, s.stopped())
+	})
+
+	select {
+	case s.evictSignal <- struct{}{}:
+	default:
+	}
+}
+
+// evictLogs drops events from the servers streams whenever their logs use
+// more than MaxTotalLogBytes, until the server is closed
+func (s *Server) evictLogs(signal, stop chan struct{}) {
+	for {
+		select {
+		case <-signal:
+		case <-stop:
+			return
+		}
+
+		for {
+			excess := atomic.LoadInt64(&s.logBytes) - s.MaxTotalLogBytes
+			if excess <= 0 {
+				break
+			}
+
+			streams := s.snapshotStreams()
+			usage := make(map[string]LogUsage, len(streams))
+
+			for id, str := range streams {
+				reply := make(chan LogUsage, 1)
+				if str.control(logUsageReq{reply: reply}) {
+					if u := <-reply; u.Events > 1 {
+						usage[id] = u
+					}
+				}
+			}
+
+			policy := s.EvictionPolicy
+			if policy == nil {
+				policy = EvictLargestLog
+			}
+
+			str := streams[policy.Choose(usage)]
+			if str == nil {
+				break
+			}
+
+			reply := make(chan int, 1)
+			if str.control(dropLogReq{bytes: int(excess), reply: reply}) && <-reply == 0 {
+				break
+			}
+		}
+	}
+}
+
+func (s *Server) snapshotStreams() map[string]*Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streams := make(map[string]*Stream, len(s.Streams))
+	for id, str := range s.Streams {
+		streams[id] = str
+	}
+
+	return streams
+}
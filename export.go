@@ -0,0 +1,121 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// exportFormat is the version of the format written by Stream.Export. It
+// changes only if the format stops being readable by earlier versions.
+const exportFormat = 1
+
+// exportedStream is the json document written by Stream.Export
+type exportedStream struct {
+	Format int `json:"format"`
+	// id the next event published will be given
+	NextID int             `json:"next_id"`
+	Events []exportedEvent `json:"events"`
+
+	// the events being exported, see exportReq
+	log EventLog
+}
+
+type exportedEvent struct {
+	ID        int               `json:"id"`
+	Event     string            `json:"event,omitempty"`
+	Data      []byte            `json:"data"`
+	Timestamp time.Time         `json:"timestamp"`
+	MaxAge    time.Duration     `json:"max_age,omitempty"`
+	Version   int               `json:"version,omitempty"`
+	Delta     bool              `json:"delta,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// Export returns the streams eventlog as json, with each events id, so it
+// can be restored by Server.ImportStream, such as in another process. The
+// document holds a format version, the id of the next event, and the
+// events, with their data base64 encoded. Event payloads are not included,
+// only their data. It returns nil if the stream has closed.
+func (str *Stream) Export() []byte {
+	reply := make(chan exportedStream, 1)
+	if !str.control(exportReq{reply: reply}) {
+		return nil
+	}
+	doc := <-reply
+
+	for i, e := range doc.log {
+		doc.Events[i] = exportedEvent{
+			ID:        e.ID,
+			Event:     e.Event,
+			Data:      e.Data,
+			Timestamp: e.Timestamp,
+			MaxAge:    e.MaxAge,
+			Version:   e.Version,
+			Delta:     e.Delta,
+			Fields:    e.Fields,
+		}
+	}
+
+	data, _ := json.Marshal(doc)
+	return data
+}
+
+// exportReq replies with the eventlog and the id of the next event, read
+// together so no event is published between them
+type exportReq struct {
+	reply chan exportedStream
+}
+
+func (r exportReq) handle(str *Stream) {
+	log := str.log.Copy()
+	r.reply <- exportedStream{
+		Format: exportFormat,
+		NextID: str.nextID(),
+		Events: make([]exportedEvent, len(log)),
+		log:    log,
+	}
+}
+
+// ImportStream restores a stream exported by Stream.Export, creating it if
+// needed and replacing its eventlog. Events keep their ids and new events
+// continue from the exported next id, so clients reconnecting with a
+// Last-Event-ID are replayed just the events they missed. ErrInvalidExport is returned if data
+// is not an export.
+func (s *Server) ImportStream(id string, data []byte) (*Stream, error) {
+	var doc exportedStream
+	if err := json.Unmarshal(data, &doc); err != nil || doc.Format != exportFormat {
+		return nil, ErrInvalidExport
+	}
+
+	events := make(EventLog, len(doc.Events))
+	for i, e := range doc.Events {
+		if e.ID < 0 || (i > 0 && e.ID <= events[i-1].ID) {
+			return nil, ErrInvalidExport
+		}
+
+		events[i] = &Event{
+			ID:        e.ID,
+			Event:     e.Event,
+			Data:      e.Data,
+			Timestamp: e.Timestamp,
+			MaxAge:    e.MaxAge,
+			Version:   e.Version,
+			Delta:     e.Delta,
+			Fields:    e.Fields,
+		}
+	}
+
+	str := s.CreateStream(id)
+
+	done := make(chan struct{})
+	if !str.control(setLogReq{events: events, keepIDs: true, nextID: doc.NextID, done: done}) {
+		return nil, ErrStreamClosed
+	}
+	<-done
+
+	return str, nil
+}
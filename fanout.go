@@ -0,0 +1,338 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// FanoutMode chooses how FanoutWorkers share out the delivery of events
+type FanoutMode int
+
+const (
+	// FanoutBarrier splits each events subscribers between the workers and
+	// waits for all of them before the next event is handled
+	FanoutBarrier FanoutMode = iota
+	// FanoutSharded always gives a subscriber to the same worker, chosen
+	// by a hash of its id. Workers deliver their queue of events without
+	// waiting for each other, so a slow share of subscribers does not hold
+	// back the rest, while each subscriber still receives events in order.
+	// The run loop only waits for the workers before replaying to a
+	// connection and for events published with PublishSync.
+	FanoutSharded
+)
+
+// shardJob is an event for the subscribers on one shard
+type shardJob struct {
+	event       *Event
+	subscribers []*Subscriber
+	batch       *shardBatch
+}
+
+// shardBatch tracks the delivery of one event across the shard workers, to
+// report it to OnBroadcastComplete once every worker has finished
+type shardBatch struct {
+	remaining int32
+	delivered int64
+	skipped   int64
+	total     int
+}
+
+// fanoutJob is a share of an events subscribers, delivered by one worker
+type fanoutJob struct {
+	event       *Event
+	subscribers []*Subscriber
+	wg          *sync.WaitGroup
+	// incremented for each subscriber the event is delivered to, or that
+	// skips it
+	delivered *int64
+	skipped   *int64
+}
+
+// broadcast delivers an event to every subscriber on the stream. If the
+// stream has more than one fanout worker, subscribers are split between the
+// workers and broadcast returns once they have all finished, so events are
+// still delivered in order. OnBroadcastComplete is then called with the
+// number of subscribers that did and did not accept the event, leaving out
+// those that skipped it.
+//
+// With RotateDelivery, the subscriber served first moves on by one for each
+// event, or with fanout workers, the share handed out first does.
+func (str *Stream) broadcast(e *Event) {
+	subscribers := str.subscribers
+
+	if e.match != nil {
+		// reuse the same slice for every targeted event
+		subscribers = str.matched[:0]
+		for i := range str.subscribers {
+			if e.match(str.subscribers[i]) {
+				subscribers = append(subscribers, str.subscribers[i])
+			}
+		}
+
+		defer func() {
+			for i := range subscribers {
+				subscribers[i] = nil
+			}
+			str.matched = subscribers[:0]
+		}()
+	}
+
+	// subscribers are delivered to one tier at a time, starting at these
+	// indexes
+	single := [2]int{0, len(subscribers)}
+	tiers := single[:]
+	if str.TieredDelivery {
+		if e.match != nil {
+			sortByTier(subscribers)
+			tiers = tierBounds(subscribers)
+		} else {
+			subscribers, tiers = str.tieredSubscribers()
+		}
+	}
+
+	if str.FanoutMode == FanoutSharded && str.FanoutWorkers > 1 {
+		str.broadcastSharded(e, subscribers)
+		return
+	}
+
+	workers := str.FanoutWorkers
+	if workers > len(subscribers) {
+		workers = len(subscribers)
+	}
+
+	// index of the subscriber, or share of subscribers, served first
+	var start int
+	if str.RotateDelivery && len(subscribers) > 0 {
+		start = str.rotation
+		str.rotation++
+	}
+
+	if workers <= 1 {
+		var delivered, skipped int64
+		for t := 0; t+1 < len(tiers); t++ {
+			tier := subscribers[tiers[t]:tiers[t+1]]
+			for i := range tier {
+				tally(tier[(start+i)%len(tier)].broadcast(e), &delivered, &skipped)
+			}
+		}
+		str.broadcastComplete(e, int(delivered), int(skipped), len(subscribers))
+		return
+	}
+
+	// shares are handed out in order, so the highest tiers go first
+	if str.TieredDelivery {
+		start = 0
+	}
+
+	if str.fanout == nil {
+		str.startFanoutWorkers()
+	}
+
+	wg := &str.fanoutWG
+	str.fanoutDelivered = 0
+	str.fanoutSkipped = 0
+
+	size := (len(subscribers) + workers - 1) / workers
+	shares := (len(subscribers) + size - 1) / size
+	for j := 0; j < shares; j++ {
+		i := (start + j) % shares * size
+		end := i + size
+		if end > len(subscribers) {
+			end = len(subscribers)
+		}
+
+		wg.Add(1)
+		str.fanout <- fanoutJob{event: e, subscribers: subscribers[i:end], wg: wg, delivered: &str.fanoutDelivered, skipped: &str.fanoutSkipped}
+	}
+
+	wg.Wait()
+
+	delivered := atomic.LoadInt64(&str.fanoutDelivered)
+	skipped := atomic.LoadInt64(&str.fanoutSkipped)
+	str.broadcastComplete(e, int(delivered), int(skipped), len(subscribers))
+}
+
+// tieredSubscribers returns the streams subscribers ordered by tier, along
+// with the index each tier starts at, sorting them again only after they
+// have changed
+func (str *Stream) tieredSubscribers() ([]*Subscriber, []int) {
+	if str.tiered == nil {
+		str.tiered = append(make([]*Subscriber, 0, len(str.subscribers)), str.subscribers...)
+		sortByTier(str.tiered)
+		str.tiers = tierBounds(str.tiered)
+	}
+	return str.tiered, str.tiers
+}
+
+// subscribersChanged forgets orderings of the subscribers that are kept
+// between events
+func (str *Stream) subscribersChanged() {
+	str.shards = nil
+	str.tiered = nil
+	str.tiers = nil
+}
+
+// sortByTier orders subscribers from the highest tier to the lowest,
+// keeping the order of those in the same tier
+func sortByTier(subscribers []*Subscriber) {
+	sort.SliceStable(subscribers, func(i, j int) bool {
+		return subscribers[i].options.Tier > subscribers[j].options.Tier
+	})
+}
+
+// tierBounds returns the index each tier of sorted subscribers starts at,
+// followed by their length
+func tierBounds(subscribers []*Subscriber) []int {
+	bounds := []int{0}
+	for i := 1; i < len(subscribers); i++ {
+		if subscribers[i].options.Tier != subscribers[i-1].options.Tier {
+			bounds = append(bounds, i)
+		}
+	}
+	return append(bounds, len(subscribers))
+}
+
+func (str *Stream) broadcastComplete(e *Event, delivered, skipped, total int) {
+	if str.OnBroadcastComplete != nil {
+		str.OnBroadcastComplete(e, delivered, total-skipped-delivered)
+	}
+}
+
+// tally counts the outcome of broadcasting an event to a subscriber
+func tally(d delivery, delivered, skipped *int64) {
+	switch d {
+	case deliveryDelivered:
+		atomic.AddInt64(delivered, 1)
+	case deliverySkipped:
+		atomic.AddInt64(skipped, 1)
+	}
+}
+
+func (str *Stream) startFanoutWorkers() {
+	str.fanout = make(chan fanoutJob, str.FanoutWorkers)
+
+	for i := 0; i < str.FanoutWorkers; i++ {
+		go func(jobs chan fanoutJob) {
+			for job := range jobs {
+				for i := range job.subscribers {
+					tally(job.subscribers[i].broadcast(job.event), job.delivered, job.skipped)
+				}
+				job.wg.Done()
+			}
+		}(str.fanout)
+	}
+}
+
+func (str *Stream) stopFanoutWorkers() {
+	if str.fanout != nil {
+		close(str.fanout)
+		str.fanout = nil
+	}
+
+	for i := range str.shardQueues {
+		close(str.shardQueues[i])
+	}
+	str.shardQueues = nil
+}
+
+// broadcastSharded queues an event on the worker for each shard of
+// subscribers. OnBroadcastComplete is called by the last worker to finish.
+// Subscribers are only split into shards again after they change, unless
+// the event is targeted.
+func (str *Stream) broadcastSharded(e *Event, subscribers []*Subscriber) {
+	if str.shardQueues == nil {
+		str.startShardWorkers()
+	}
+
+	shards := str.shards
+	if shards == nil || e.match != nil {
+		shards = str.partition(subscribers)
+		if e.match == nil {
+			str.shards = shards
+		}
+	}
+
+	var batch *shardBatch
+	if str.OnBroadcastComplete != nil {
+		batch = &shardBatch{total: len(subscribers)}
+		for i := range shards {
+			if len(shards[i]) > 0 {
+				batch.remaining++
+			}
+		}
+		if batch.remaining == 0 {
+			str.broadcastComplete(e, 0, 0, 0)
+		}
+	}
+
+	for i := range shards {
+		if len(shards[i]) == 0 {
+			continue
+		}
+		str.shardWG.Add(1)
+		str.shardQueues[i] <- shardJob{event: e, subscribers: shards[i], batch: batch}
+	}
+
+	if e.sync != nil {
+		str.settleShards()
+	}
+}
+
+// partition splits subscribers into a new slice for each shard worker
+func (str *Stream) partition(subscribers []*Subscriber) [][]*Subscriber {
+	shards := make([][]*Subscriber, len(str.shardQueues))
+	for i := range subscribers {
+		n := shardOf(subscribers[i].id, len(shards))
+		shards[n] = append(shards[n], subscribers[i])
+	}
+	return shards
+}
+
+// shardOf returns the shard a subscriber id belongs to
+func shardOf(id string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// settleShards waits until the shard workers have delivered every event
+// queued on them. It must only be called from the run loop.
+func (str *Stream) settleShards() {
+	str.shardWG.Wait()
+}
+
+func (str *Stream) startShardWorkers() {
+	str.shardQueues = make([]chan shardJob, str.FanoutWorkers)
+
+	for i := range str.shardQueues {
+		str.shardQueues[i] = make(chan shardJob, cap(str.event))
+
+		go func(jobs chan shardJob) {
+			for job := range jobs {
+				var delivered, skipped int64
+				for i := range job.subscribers {
+					tally(job.subscribers[i].broadcast(job.event), &delivered, &skipped)
+				}
+
+				if b := job.batch; b != nil {
+					atomic.AddInt64(&b.delivered, delivered)
+					atomic.AddInt64(&b.skipped, skipped)
+					// the last shard reads the totals once every shard
+					// has added its own
+					if atomic.AddInt32(&b.remaining, -1) == 0 {
+						n := atomic.LoadInt64(&b.delivered)
+						m := atomic.LoadInt64(&b.skipped)
+						str.broadcastComplete(job.event, int(n), int(m), b.total)
+					}
+				}
+				str.shardWG.Done()
+			}
+		}(str.shardQueues[i])
+	}
+}
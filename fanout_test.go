@@ -0,0 +1,259 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamFanoutWorkers(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.FanoutWorkers = 4
+
+	conns := make([]chan *Event, 10)
+	for i := range conns {
+		sub := NewSubscriber("test-" + strconv.Itoa(i))
+		s.addSubscriber(sub)
+		conns[i] = sub.Connect()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 3; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	for _, c := range conns {
+		for i := 0; i < 3; i++ {
+			select {
+			case e := <-c:
+				assert.Equal(t, strconv.Itoa(i), string(e.Data))
+			case <-time.After(time.Second):
+				t.Fatal("event was not delivered")
+			}
+		}
+	}
+}
+
+func TestStreamRotateDelivery(t *testing.T) {
+	s := &Stream{RotateDelivery: true}
+
+	var order []string
+	for _, key := range []string{"a", "b", "c"} {
+		key := key
+		s.subscribers = append(s.subscribers, NewSubscriberWithOptions(key, SubscriberOptions{
+			Filter: func(e *Event) bool {
+				order = append(order, key)
+				return false
+			},
+		}))
+	}
+
+	for i := 0; i < 4; i++ {
+		s.broadcast(&Event{Data: []byte("ping")})
+	}
+
+	assert.Equal(t, "abc"+"bca"+"cab"+"abc", strings.Join(order, ""))
+
+	// registration order is kept when rotation is off
+	s.RotateDelivery = false
+	order = nil
+	s.broadcast(&Event{Data: []byte("ping")})
+	s.broadcast(&Event{Data: []byte("ping")})
+	assert.Equal(t, "abcabc", strings.Join(order, ""))
+}
+
+func TestStreamFanoutSharded(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.FanoutWorkers = 4
+	s.FanoutMode = FanoutSharded
+
+	completed := make(chan int, 100)
+	s.OnBroadcastComplete = func(e *Event, delivered, failed int) {
+		completed <- delivered
+	}
+
+	conns := make([]chan *Event, 20)
+	for i := range conns {
+		sub := NewSubscriber("test-" + strconv.Itoa(i))
+		s.addSubscriber(sub)
+		conns[i] = sub.Connect()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 50; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	// every subscriber receives its events in order
+	for _, c := range conns {
+		for i := 0; i < 50; i++ {
+			select {
+			case e := <-c:
+				assert.Equal(t, strconv.Itoa(i), string(e.Data))
+			case <-time.After(time.Second):
+				t.Fatal("event was not delivered")
+			}
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, 20, <-completed)
+	}
+
+	// events published synchronously have been delivered on return
+	assert.Nil(t, s.PublishSync(&Event{Data: []byte("sync")}))
+	for _, c := range conns {
+		assert.Len(t, c, 1)
+	}
+
+	// subscribers keep their shard
+	assert.Equal(t, shardOf("a", 4), shardOf("a", 4))
+}
+
+func TestStreamFanoutShardedTally(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.FanoutWorkers = 8
+	s.FanoutMode = FanoutSharded
+
+	type tally struct{ delivered, failed int }
+	completed := make(chan tally, 200)
+	s.OnBroadcastComplete = func(e *Event, delivered, failed int) {
+		completed <- tally{delivered, failed}
+	}
+
+	// half the subscribers skip every event
+	for i := 0; i < 40; i++ {
+		skip := i%2 == 0
+		sub := NewSubscriberWithOptions("test-"+strconv.Itoa(i), SubscriberOptions{
+			Filter: func(e *Event) bool { return !skip },
+		})
+		s.addSubscriber(sub)
+		c := sub.Connect()
+
+		go func() {
+			for range c {
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 200; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	// every shard's share is counted, whichever finishes last
+	for i := 0; i < 200; i++ {
+		select {
+		case got := <-completed:
+			assert.Equal(t, tally{20, 0}, got)
+		case <-time.After(time.Second):
+			t.Fatal("broadcast did not complete")
+		}
+	}
+}
+
+func TestStreamTieredDelivery(t *testing.T) {
+	s := &Stream{TieredDelivery: true, subscriberIndex: make(map[string]int)}
+
+	var order []string
+	for _, key := range []string{"free-a", "premium-a", "free-b", "staff", "premium-b"} {
+		key := key
+		tier := 0
+		switch {
+		case strings.HasPrefix(key, "premium"):
+			tier = 1
+		case key == "staff":
+			tier = 2
+		}
+		s.appendSubscriber(NewSubscriberWithOptions(key, SubscriberOptions{
+			Tier: tier,
+			Filter: func(e *Event) bool {
+				order = append(order, key)
+				return false
+			},
+		}))
+	}
+
+	s.broadcast(&Event{Data: []byte("ping")})
+	assert.Equal(t, []string{"staff", "premium-a", "premium-b", "free-a", "free-b"}, order)
+
+	// each tier is rotated on its own
+	s.RotateDelivery = true
+	order = nil
+	s.broadcast(&Event{Data: []byte("ping")})
+	s.broadcast(&Event{Data: []byte("ping")})
+	assert.Equal(t, []string{
+		"staff", "premium-a", "premium-b", "free-a", "free-b",
+		"staff", "premium-b", "premium-a", "free-b", "free-a",
+	}, order)
+
+	// targeted events are ordered the same way
+	s.RotateDelivery = false
+	order = nil
+	s.broadcast(&Event{match: func(sub *Subscriber) bool {
+		return sub.Key() != "staff"
+	}})
+	assert.Equal(t, []string{"premium-a", "premium-b", "free-a", "free-b"}, order)
+}
+
+func benchmarkStreamBroadcast(b *testing.B, workers int, mode FanoutMode) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.FanoutWorkers = workers
+	s.FanoutMode = mode
+
+	for i := 0; i < 50000; i++ {
+		sub := NewSubscriber(strconv.Itoa(i))
+		c := &Connection{conn: make(chan *Event, 64)}
+		sub.connections = append(sub.connections, c)
+		s.subscribers = append(s.subscribers, sub)
+
+		go func() {
+			for range c.conn {
+			}
+		}()
+	}
+
+	e := &Event{Data: []byte("ping")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.broadcast(e)
+	}
+	s.settleShards()
+	b.StopTimer()
+
+	s.stopFanoutWorkers()
+	for i := range s.subscribers {
+		s.subscribers[i].DisconnectAll()
+	}
+}
+
+func BenchmarkStreamBroadcastSerial(b *testing.B) {
+	benchmarkStreamBroadcast(b, 0, FanoutBarrier)
+}
+
+func BenchmarkStreamBroadcastPooled(b *testing.B) {
+	benchmarkStreamBroadcast(b, 8, FanoutBarrier)
+}
+
+func BenchmarkStreamBroadcastSharded(b *testing.B) {
+	benchmarkStreamBroadcast(b, 8, FanoutSharded)
+}
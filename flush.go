@@ -0,0 +1,35 @@
+//go:build go1.20
+// +build go1.20
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "net/http"
+
+// newFlusher returns a function that flushes w, or nil if w cannot be
+// flushed. Writers wrapped by middleware are flushed through a
+// http.ResponseController, which unwraps them.
+func newFlusher(w http.ResponseWriter) func() error {
+	if !canFlush(w) {
+		return nil
+	}
+
+	return http.NewResponseController(w).Flush
+}
+
+// canFlush reports whether w, or any writer it wraps, supports flushing
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
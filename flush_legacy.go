@@ -0,0 +1,24 @@
+//go:build !go1.20
+// +build !go1.20
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "net/http"
+
+// newFlusher returns a function that flushes w, or nil if w cannot be
+// flushed
+func newFlusher(w http.ResponseWriter) func() error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+
+	return func() error {
+		flusher.Flush()
+		return nil
+	}
+}
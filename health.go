@@ -0,0 +1,121 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHealthTimeout is how long a streams run loop has to answer a
+	// health check when the stream has no HealthTimeout
+	DefaultHealthTimeout = time.Second
+	// DefaultMaxSaturation is how long a streams event buffer can stay
+	// full before it is unhealthy, when the stream has no MaxSaturation
+	DefaultMaxSaturation = time.Second * 30
+)
+
+// pingReq checks that the run loop is answering requests
+type pingReq struct {
+	reply chan struct{}
+}
+
+func (r pingReq) handle(str *Stream) {
+	r.reply <- struct{}{}
+}
+
+// recordSaturation notes when the event buffer became full, or clears it
+// once the buffer has room
+func (str *Stream) recordSaturation() {
+	if cap(str.event) > 0 && len(str.event) == cap(str.event) {
+		if atomic.LoadInt64(&str.saturatedSince) == 0 {
+			atomic.StoreInt64(&str.saturatedSince, time.Now().UnixNano())
+		}
+		return
+	}
+	atomic.StoreInt64(&str.saturatedSince, 0)
+}
+
+// Healthy reports whether the stream is working normally, see Health
+func (str *Stream) Healthy() bool {
+	return str.Health() == nil
+}
+
+// Health returns why the stream is unhealthy, or nil if it is not. A
+// stream is unhealthy if:
+//   - it has closed, returning ErrStreamClosed
+//   - its run loop does not answer within HealthTimeout, returning
+//     ErrStreamUnresponsive
+//   - its event buffer has been full for longer than MaxSaturation,
+//     returning ErrStreamSaturated
+func (str *Stream) Health() error {
+	limit := str.MaxSaturation
+	if limit <= 0 {
+		limit = DefaultMaxSaturation
+	}
+
+	if since := atomic.LoadInt64(&str.saturatedSince); since != 0 && time.Since(time.Unix(0, since)) > limit {
+		return ErrStreamSaturated
+	}
+
+	timeout := str.HealthTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	reply := make(chan struct{}, 1)
+
+	select {
+	case str.ctrl <- pingReq{reply: reply}:
+	case <-str.done:
+		return ErrStreamClosed
+	case <-t.C:
+		return ErrStreamUnresponsive
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-str.done:
+		return ErrStreamClosed
+	case <-t.C:
+		return ErrStreamUnresponsive
+	}
+}
+
+// Healthy returns an error naming each of the servers streams that is
+// unhealthy, see Stream.Health, or nil if every stream is healthy
+func (s *Server) Healthy() error {
+	streams := s.snapshotStreams()
+
+	ids := make([]string, 0, len(streams))
+	for id := range streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var unhealthy []string
+	var first error
+	for _, id := range ids {
+		if err := streams[id].Health(); err != nil && err != ErrStreamClosed {
+			unhealthy = append(unhealthy, id)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	if first == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: streams %v", first, unhealthy)
+}
@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamHealthy(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	assert.True(t, s.Healthy())
+
+	s.close()
+	<-s.done
+	assert.False(t, s.Healthy())
+	assert.Equal(t, ErrStreamClosed, s.Health())
+
+	// a run loop that never started cannot answer
+	stuck := newConfiguredStream(1, StreamConfig{})
+	stuck.HealthTimeout = time.Millisecond * 10
+	assert.Equal(t, ErrStreamUnresponsive, stuck.Health())
+
+	// a buffer that stays full
+	full := newStream(1)
+	defer full.close()
+	full.MaxSaturation = time.Millisecond * 10
+	atomic.StoreInt64(&full.saturatedSince, time.Now().Add(-time.Second).UnixNano())
+	assert.Equal(t, ErrStreamSaturated, full.Health())
+
+	// draining the buffer clears it
+	full.recordSaturation()
+	assert.True(t, full.Healthy())
+}
+
+func TestServerHealthy(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	s.CreateStream("a")
+	b := s.CreateStream("b")
+	assert.Nil(t, s.Healthy())
+
+	b.MaxSaturation = time.Millisecond * 10
+	atomic.StoreInt64(&b.saturatedSince, time.Now().Add(-time.Second).UnixNano())
+
+	err := s.Healthy()
+	assert.ErrorIs(t, err, ErrStreamSaturated)
+	assert.Contains(t, err.Error(), "[b]")
+}
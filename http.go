@@ -0,0 +1,447 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FingerprintParam is the query parameter clients present the fingerprint
+// of the eventlog they already hold in, see Stream.Fingerprint. The
+// X-Fingerprint header is also accepted.
+const FingerprintParam = "fingerprint"
+
+// jsonEvent is the json representation of an event
+type jsonEvent struct {
+	ID   int    `json:"id"`
+	Data string `json:"data"`
+}
+
+func newJSONEvent(e *Event) jsonEvent {
+	return jsonEvent{
+		ID:   e.ID,
+		Data: string(e.Data),
+	}
+}
+
+// StreamHistoryHandler returns a handler that writes a streams eventlog as a
+// single response and closes the connection. If the request carries a
+// Last-Event-ID header, only events after that id are returned. The id is
+// checked as StreamHandler checks it, see Stream.ValidateLastEventID.
+//
+// Events are written as a json array, or as newline delimited json if the
+// client accepts application/x-ndjson.
+func StreamHistoryHandler(str *Stream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events := str.History()
+
+		id, err := str.validateLastEventID(r.Header.Get("Last-Event-ID"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if id != "" {
+			evid, err := strconv.Atoi(id)
+			if err != nil {
+				http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			events = events.After(evid)
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			for i := range events {
+				_ = enc.Encode(newJSONEvent(events[i]))
+			}
+			return
+		}
+
+		out := make([]jsonEvent, len(events))
+		for i := range events {
+			out[i] = newJSONEvent(events[i])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
+
+// StreamHandler returns a handler that subscribes each request to a stream
+// and writes its events to the client as server-sent events, until either
+// the client disconnects or the stream is closed.
+//
+// Requests are rejected with 503 Service Unavailable while the stream is
+// draining.
+//
+// Clients reconnecting with a Last-Event-ID header are only sent the events
+// they missed, see Stream.ValidateLastEventID. Clients that present the
+// fingerprint of the eventlog they hold, see FingerprintParam, are sent an
+// UpToDateEvent in place of the replay if it still matches.
+//
+// Event data is serialized by the encoder negotiated from the requests
+// Accept header, see Stream.Encoders. Events are flushed to the client as
+// they are written, or every Stream.FlushInterval if one is set.
+func StreamHandler(str *Stream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveStream(str, w, r)
+	})
+}
+
+// StreamResolverHandler returns a handler that behaves like StreamHandler,
+// but subscribes each request to the stream returned by resolve. This lets
+// the stream be chosen from any part of the request, such as its host, path
+// or authentication. Requests are rejected with 404 Not Found if resolve
+// returns ErrStreamNotFound or a nil stream, and with 403 Forbidden for any
+// other error.
+func StreamResolverHandler(resolve func(r *http.Request) (*Stream, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		str, err := resolve(r)
+		switch {
+		case errors.Is(err, ErrStreamNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case str == nil:
+			http.Error(w, ErrStreamNotFound.Error(), http.StatusNotFound)
+			return
+		}
+
+		serveStream(str, w, r)
+	})
+}
+
+// serveStream subscribes a request to a stream and writes its events to the
+// client until either disconnects
+func serveStream(str *Stream, w http.ResponseWriter, r *http.Request) {
+	flusher := newFlusher(w)
+	if flusher == nil {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID, err := str.validateLastEventID(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx buffers proxied responses by default, which holds back events
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	compress := str.CompressReplay && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	for k, v := range str.ResponseHeaders {
+		w.Header()[k] = v
+	}
+
+	sub, ok := subscribeRequest(str, w, r)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	// a client reconnecting with a token replaces its previous subscriber,
+	// resuming from the last event that was sent to it
+	if str.ReconnectTokenTTL > 0 {
+		if id, ok := str.parseReconnectToken(requestReconnectToken(r)); ok {
+			if last := str.takeover(id); last >= 0 && lastID == "" {
+				lastID = strconv.Itoa(last)
+			}
+		}
+	}
+
+	c := sub.connect(replayStart(lastID), requestFingerprint(r), ConnectionMetadata{
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	})
+	// closing the connection first releases the stream if it is blocked
+	// delivering to it, which sub.Close alone would wait on
+	defer c.close(nil)
+	c.encoder = str.negotiateEncoder(r.Header.Get("Accept"))
+
+	w.WriteHeader(http.StatusOK)
+	if err := flusher(); err != nil {
+		return
+	}
+
+	ew := newEventWriter(str, w, flusher, c)
+
+	if compress {
+		ew.compress(w)
+		defer ew.close()
+	}
+
+	if len(str.Preamble) > 0 {
+		if _, err := ew.w.Write(str.Preamble); err != nil {
+			return
+		}
+	}
+
+	cfg := str.settings()
+
+	if cfg.RetryInterval > 0 {
+		if err := ew.writeRetry(cfg.RetryInterval); err != nil {
+			return
+		}
+	}
+
+	if str.ReconnectTokenTTL > 0 {
+		token := &Event{Event: ReconnectTokenEvent}
+		if err := ew.writeEvent(token, []byte(str.reconnectToken(sub)), 0); err != nil {
+			return
+		}
+	}
+
+	if len(str.Preamble) > 0 || cfg.RetryInterval > 0 || str.ReconnectTokenTTL > 0 {
+		if err := ew.flush(); err != nil {
+			return
+		}
+	}
+
+	if compress {
+		if err := writeReplay(c, ew, str.done); err != nil {
+			return
+		}
+	}
+
+	flushTicker, interval := restartTicker(nil, cfg.FlushInterval)
+	keepAliveTicker, keepAlive := restartTicker(nil, cfg.KeepAlive)
+	defer func() {
+		restartTicker(flushTicker, 0)
+		restartTicker(keepAliveTicker, 0)
+	}()
+
+	var reauthorize <-chan time.Time
+	if str.Reauthorize != nil {
+		d := str.ReauthorizeInterval
+		if d <= 0 {
+			d = DefaultReauthorizeInterval
+		}
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		reauthorize = ticker.C
+	}
+
+	for {
+		select {
+		case e, ok := <-c.conn:
+			if !ok {
+				return
+			}
+
+			if err := ew.write(e); err != nil {
+				return
+			}
+
+			// keepalives are only needed once the connection is idle
+			if keepAliveTicker != nil {
+				keepAliveTicker.Reset(cfg.KeepAlive)
+			}
+
+			if interval == nil {
+				if err := coalesce(c, ew, str.CoalesceBytes); err != nil {
+					return
+				}
+				if err := ew.flush(); err != nil {
+					return
+				}
+			}
+		case <-interval:
+			if err := ew.flush(); err != nil {
+				return
+			}
+		case <-c.flushNow:
+			if err := drain(c, ew); err != nil {
+				return
+			}
+			if err := ew.flush(); err != nil {
+				return
+			}
+		case <-keepAlive:
+			if err := ew.writeComment("keepalive"); err != nil {
+				return
+			}
+			if err := ew.flush(); err != nil {
+				return
+			}
+		case <-reauthorize:
+			if err := str.Reauthorize(c); err != nil {
+				sub.disconnect(c, ReasonAuthRevoked)
+				if err := drain(c, ew); err == nil {
+					ew.flush()
+				}
+				return
+			}
+		case <-cfg.changed:
+			prev := cfg
+			cfg = str.settings()
+
+			if cfg.FlushInterval != prev.FlushInterval {
+				flushTicker, interval = restartTicker(flushTicker, cfg.FlushInterval)
+			}
+			if cfg.KeepAlive != prev.KeepAlive {
+				keepAliveTicker, keepAlive = restartTicker(keepAliveTicker, cfg.KeepAlive)
+			}
+			if cfg.RetryInterval != prev.RetryInterval {
+				if err := ew.writeRetry(cfg.RetryInterval); err != nil {
+					return
+				}
+			}
+			if err := ew.flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-str.done:
+			// write any close event queued before the stream closed
+			if err := drain(c, ew); err == nil {
+				ew.flush()
+			}
+			return
+		}
+	}
+}
+
+// subscribeRequest registers a subscriber for a handlers request, unless the
+// client has already gone away. It returns false if the request should not
+// be served any further, having answered it if the client is still there.
+func subscribeRequest(str *Stream, w http.ResponseWriter, r *http.Request) (*Subscriber, bool) {
+	// clients that disconnect before they are subscribed are never registered
+	if r.Context().Err() != nil {
+		return nil, false
+	}
+
+	sub := newRequestSubscriber(str, r)
+	if err := str.addSubscriber(sub); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	return sub, true
+}
+
+// restartTicker stops t, returning a new ticker for d along with its
+// channel, or nils if d is zero
+func restartTicker(t *time.Ticker, d time.Duration) (*time.Ticker, <-chan time.Time) {
+	if t != nil {
+		t.Stop()
+	}
+	if d <= 0 {
+		return nil, nil
+	}
+
+	t = time.NewTicker(d)
+	return t, t.C
+}
+
+// newRequestSubscriber creates the subscriber for a handlers request
+func newRequestSubscriber(str *Stream, r *http.Request) *Subscriber {
+	opts := SubscriberOptions{MaxVersion: acceptVersion(r.Header.Get("Accept"))}
+	if str.SubscriberName != nil {
+		opts.Name = str.SubscriberName(r)
+	}
+	return NewSubscriberWithOptions("", opts)
+}
+
+// requestFingerprint returns the eventlog fingerprint sent with a request
+func requestFingerprint(r *http.Request) string {
+	if fp := r.URL.Query().Get(FingerprintParam); fp != "" {
+		return fp
+	}
+	return r.Header.Get("X-Fingerprint")
+}
+
+// replayStart returns the id replay should start from for a client whose
+// last received event was lastID. Ids that are empty or do not belong to
+// the eventlog replay everything.
+func replayStart(lastID string) string {
+	id, err := strconv.Atoi(lastID)
+	if err != nil || id < 0 {
+		return "0"
+	}
+	return strconv.Itoa(id + 1)
+}
+
+// writeReplay writes events to a connection until its replay has completed
+// and every replayed event has been written, then flushes them as a single
+// block
+func writeReplay(c *Connection, ew *eventWriter, done <-chan struct{}) error {
+	t := time.NewTicker(replayPollInterval)
+	defer t.Stop()
+
+	for c.isReplaying() || len(c.conn) > 0 {
+		select {
+		case e, ok := <-c.conn:
+			if !ok {
+				return nil
+			}
+			if err := ew.write(e); err != nil {
+				return err
+			}
+		case <-t.C:
+		case <-done:
+			return nil
+		}
+	}
+
+	return ew.flush()
+}
+
+// coalesce writes events already queued on a connection into the same
+// flush as the last, until limit bytes are buffered, so a short replay and
+// the live events after it reach the client together
+func coalesce(c *Connection, ew *eventWriter, limit int) error {
+	for ew.w.Buffered() < limit {
+		select {
+		case e, ok := <-c.conn:
+			if !ok {
+				return nil
+			}
+			if err := ew.write(e); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// drain writes any events already queued on a connection, without waiting
+// for more to arrive
+func drain(c *Connection, ew *eventWriter) error {
+	for {
+		select {
+		case e, ok := <-c.conn:
+			if !ok {
+				return nil
+			}
+			if err := ew.write(e); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
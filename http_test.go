@@ -0,0 +1,807 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamHistoryHandler(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	req := httptest.NewRequest(http.MethodGet, "/history", nil)
+	rec := httptest.NewRecorder()
+	StreamHistoryHandler(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `[{"id":0,"data":"0"},{"id":1,"data":"1"},{"id":2,"data":"2"}]`+"\n", rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/history", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	req.Header.Set("Last-Event-ID", "0")
+	rec = httptest.NewRecorder()
+	StreamHistoryHandler(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"id\":1,\"data\":\"1\"}\n{\"id\":2,\"data\":\"2\"}\n", rec.Body.String())
+	assert.Len(t, s.subscribers, 0)
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	var frame string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\n" {
+			return frame
+		}
+		frame += line
+	}
+}
+
+func TestStreamHandlerEncoders(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.Encoders["application/x-upper"] = EncoderFunc(func(e *Event) ([]byte, error) {
+		return bytes.ToUpper(e.Data), nil
+	})
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	connect := func(accept string) *bufio.Reader {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "no", resp.Header.Get("X-Accel-Buffering"))
+		assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+		return bufio.NewReader(resp.Body)
+	}
+
+	s.ResponseHeaders = http.Header{"Vary": {"Accept"}}
+
+	jc := connect("text/event-stream")
+	uc := connect("text/event-stream, application/x-upper")
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("ping")})
+	s.publish(&Event{Event: "state", Payload: map[string]int{"count": 1}})
+
+	assert.Equal(t, "id: 0\ndata: ping\n", readEvent(t, jc))
+	assert.Equal(t, "id: 1\nevent: state\ndata: {\"count\":1}\n", readEvent(t, jc))
+	assert.Equal(t, "id: 0\ndata: PING\n", readEvent(t, uc))
+	assert.Equal(t, "id: 1\nevent: state\ndata: \n", readEvent(t, uc))
+}
+
+func TestStreamHandlerFlush(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.FlushInterval = time.Hour
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	frames := make(chan string)
+	go func() {
+		var frame string
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\n" {
+				frames <- frame
+				frame = ""
+				continue
+			}
+			frame += line
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("ping")})
+
+	select {
+	case <-frames:
+		t.Fatal("event was flushed before the flush interval")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	s.Flush()
+
+	select {
+	case frame := <-frames:
+		assert.Equal(t, "id: 0\ndata: ping\n", frame)
+	case <-time.After(time.Second):
+		t.Fatal("event was not flushed")
+	}
+}
+
+func TestStreamHandlerLastEventID(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.ValidateLastEventID = func(id string) (string, error) {
+		if id == "spoofed" {
+			return "", errors.New("unknown event id")
+		}
+		if id == "legacy-2" {
+			return "1", nil
+		}
+		return id, nil
+	}
+
+	for i := 0; i < 4; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	connect := func(id string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Last-Event-ID", id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := connect("spoofed")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	r := bufio.NewReader(connect("legacy-2").Body)
+	assert.Equal(t, "id: 2\ndata: 2\n", readEvent(t, r))
+	assert.Equal(t, "id: 3\ndata: 3\n", readEvent(t, r))
+}
+
+func TestStreamHandlerFingerprint(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	fp := s.Fingerprint()
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	connect := func(req *http.Request) *bufio.Reader {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body)
+	}
+
+	// a client holding the eventlog is not replayed it again
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"?"+FingerprintParam+"="+fp, nil)
+	r := connect(req)
+	assert.Equal(t, "event: "+UpToDateEvent+"\ndata: "+fp+"\n", readEvent(t, r))
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("X-Fingerprint", fp)
+	h := connect(req)
+	assert.Equal(t, "event: "+UpToDateEvent+"\ndata: "+fp+"\n", readEvent(t, h))
+
+	s.publish(&Event{Data: []byte("live")})
+	assert.Equal(t, "id: 3\ndata: live\n", readEvent(t, r))
+
+	// a stale fingerprint is replayed everything
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"?"+FingerprintParam+"="+fp, nil)
+	assert.Equal(t, "id: 0\ndata: 0\n", readEvent(t, connect(req)))
+}
+
+func TestStreamHandlerEventIDs(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.EventIDs = NewIDGenerator("eu-orders")
+
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	connect := func(id string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Last-Event-ID", id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	r := bufio.NewReader(connect("eu-orders-1").Body)
+	assert.Equal(t, "id: eu-orders-2\ndata: 2\n", readEvent(t, r))
+
+	assert.Equal(t, http.StatusBadRequest, connect("3").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, connect("eu-orders-x").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, connect("us-orders-2").StatusCode)
+
+	// the history handler accepts the same ids
+	req := httptest.NewRequest(http.MethodGet, "/history", nil)
+	req.Header.Set("Last-Event-ID", "eu-orders-1")
+	rec := httptest.NewRecorder()
+	StreamHistoryHandler(s).ServeHTTP(rec, req)
+	assert.Equal(t, `[{"id":2,"data":"2"}]`+"\n", rec.Body.String())
+
+	req.Header.Set("Last-Event-ID", "us-orders-1")
+	rec = httptest.NewRecorder()
+	StreamHistoryHandler(s).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	g := NewIDGenerator("eu-orders")
+	_, err := g.Parse("eu-orders--1")
+	assert.Equal(t, ErrInvalidEventID, err)
+	_, err = g.Parse("orders-1")
+	assert.Equal(t, ErrForeignEventID, err)
+	seq, err := g.Parse(g.Format(42))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, seq)
+}
+
+func TestStreamHandlerDraining(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.SetDraining(true)
+
+	dresp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dresp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, dresp.StatusCode)
+
+	s.publish(&Event{Data: []byte("ping")})
+
+	assert.Equal(t, "id: 0\ndata: ping\n", readEvent(t, bufio.NewReader(resp.Body)))
+	assert.Len(t, s.subscribers, 1)
+}
+
+func TestStreamDrainDeadline(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	// the client never disconnects, so is disconnected at the deadline
+	assert.Equal(t, context.DeadlineExceeded, s.Drain(ctx))
+	assert.Equal(t, 0, s.SubscriberCount())
+	assert.True(t, s.Draining())
+
+	// with no subscribers left, draining returns straight away
+	assert.Nil(t, s.Drain(context.Background()))
+}
+
+// wrappedWriter hides the http.Flusher of the writer it wraps, like a
+// logging middleware would
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+func (w wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestStreamHandlerWrappedWriter(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	h := StreamHandler(s)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(wrappedWriter{w}, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("ping")})
+
+	assert.Equal(t, "id: 0\ndata: ping\n", readEvent(t, bufio.NewReader(resp.Body)))
+}
+
+func TestStreamHandlerCloseEvent(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	s.EmitCloseEvents = true
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.close()
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, "event: _close\ndata: {\"reason\":\"server_shutdown\"}\n", readEvent(t, r))
+}
+
+func TestStreamHandlerReplayMode(t *testing.T) {
+	srv := New()
+	defer srv.Close()
+
+	srv.MaxTotalLogBytes = 20
+	s := srv.CreateStream("test")
+	s.EmitReplayMode = true
+
+	for i := 0; i < 10; i++ {
+		srv.Publish("test", []byte("data"))
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	history := s.History()
+	assert.Equal(t, 9, history[len(history)-1].ID)
+	oldest := history[0].ID
+	assert.True(t, oldest > 1)
+
+	ts := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(ts.Close)
+
+	connect := func(lastID string) *bufio.Reader {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body)
+	}
+
+	r := connect("8")
+	assert.Equal(t, "event: _replay\ndata: incremental\n", readEvent(t, r))
+	assert.Equal(t, "id: 9\ndata: data\n", readEvent(t, r))
+
+	// the events after 1 have been evicted, so the client may have missed some
+	r = connect("1")
+	assert.Equal(t, "event: _replay\ndata: full\n", readEvent(t, r))
+	assert.Equal(t, "id: "+strconv.Itoa(oldest)+"\ndata: data\n", readEvent(t, r))
+
+	r = connect("")
+	assert.Equal(t, "event: _replay\ndata: full\n", readEvent(t, r))
+
+	// a client ahead of the eventlog is also replayed everything
+	r = connect("50")
+	assert.Equal(t, "event: _replay\ndata: full\n", readEvent(t, r))
+	assert.Equal(t, "id: "+strconv.Itoa(oldest)+"\ndata: data\n", readEvent(t, r))
+}
+
+func TestStreamHandlerReauthorize(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.EmitCloseEvents = true
+	s.ReauthorizeInterval = time.Millisecond * 50
+
+	var revoked int32
+	s.Reauthorize = func(c *Connection) error {
+		if c.Metadata.Header.Get("Authorization") != "Bearer token" || atomic.LoadInt32(&revoked) == 1 {
+			return errors.New("token revoked")
+		}
+		return nil
+	}
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("ping")})
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, "id: 0\ndata: ping\n", readEvent(t, r))
+
+	atomic.StoreInt32(&revoked, 1)
+
+	assert.Equal(t, "event: _close\ndata: {\"reason\":\"auth_revoked\"}\n", readEvent(t, r))
+}
+
+func TestStreamHandlerRetryAndKeepAlive(t *testing.T) {
+	srv := New()
+	defer srv.Close()
+
+	srv.DefaultStreamConfig = StreamConfig{
+		RetryInterval: time.Second * 3,
+		KeepAlive:     time.Millisecond * 50,
+	}
+	s := srv.CreateStream("test")
+
+	ts := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, "retry: 3000\n", readEvent(t, r))
+	assert.Equal(t, ": keepalive\n", readEvent(t, r))
+}
+
+func TestStreamHandlerCancelledRequest(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	var reserved int
+	s.reserveSubscriber = func() bool {
+		reserved++
+		return true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, h := range []http.Handler{
+		StreamHandler(s),
+		LongPollHandler(s, time.Second),
+		StreamArrayHandler(s, time.Second),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 0, reserved)
+	assert.Equal(t, 0, s.SubscriberCount())
+}
+
+func TestStreamHandlerKeepAliveWhenIdle(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.KeepAlive = time.Millisecond * 100
+
+	ts := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	r := bufio.NewReader(resp.Body)
+
+	// a busy stream is not sent keepalives
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			s.publish(&Event{Data: []byte("busy")})
+			time.Sleep(time.Millisecond * 20)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "id: "+strconv.Itoa(i)+"\ndata: busy\n", readEvent(t, r))
+	}
+	<-done
+
+	// once idle, it is
+	assert.Equal(t, ": keepalive\n", readEvent(t, r))
+}
+
+func TestStreamReconfigure(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+
+	ts := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	r := bufio.NewReader(resp.Body)
+
+	s.publish(&Event{Data: []byte("before")})
+	assert.Equal(t, "id: 0\ndata: before\n", readEvent(t, r))
+
+	// the open connection starts sending keepalives, without reconnecting
+	assert.Nil(t, s.Reconfigure(StreamConfig{
+		KeepAlive:     time.Millisecond * 50,
+		RetryInterval: time.Second * 2,
+		MaxInactivity: time.Hour,
+	}))
+	assert.Equal(t, "retry: 2000\n", readEvent(t, r))
+	assert.Equal(t, ": keepalive\n", readEvent(t, r))
+	assert.Equal(t, 1, s.SubscriberCount())
+
+	st := s.Stats()
+	assert.True(t, st.UntilReap > DefaultMaxInactivity)
+
+	s.publish(&Event{Data: []byte("after")})
+	for {
+		if e := readEvent(t, r); e != ": keepalive\n" {
+			assert.Equal(t, "id: 1\ndata: after\n", e)
+			break
+		}
+	}
+
+	s.close()
+	assert.Equal(t, ErrStreamClosed, s.Reconfigure(StreamConfig{}))
+}
+
+func TestStreamHandlerPreamble(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.Preamble = PaddingPreamble(2048)
+	s.RetryInterval = time.Second
+
+	ts := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	r := bufio.NewReader(resp.Body)
+	padding := readEvent(t, r)
+	assert.Equal(t, string(bytes.Repeat([]byte(":"), 2046))+"\n", padding)
+	assert.Equal(t, "retry: 1000\n", readEvent(t, r))
+
+	s.publish(&Event{Data: []byte("hello")})
+	assert.Equal(t, "id: 0\ndata: hello\n", readEvent(t, r))
+}
+
+func TestStreamResolverHandler(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	s.CreateStream("news")
+
+	srv := httptest.NewServer(StreamResolverHandler(func(r *http.Request) (*Stream, error) {
+		if r.URL.Query().Get("token") != "secret" {
+			return nil, errors.New("invalid token")
+		}
+		if str := s.GetStream(r.URL.Path[1:]); str != nil {
+			return str, nil
+		}
+		return nil, ErrStreamNotFound
+	}))
+	t.Cleanup(srv.Close)
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("/news").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/sport?token=secret").StatusCode)
+
+	resp := get("/news?token=secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.Publish("news", []byte("ping"))
+
+	assert.Equal(t, "id: 0\ndata: ping\n", readEvent(t, bufio.NewReader(resp.Body)))
+}
+
+func TestStreamHandlerCompressReplay(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.CompressReplay = true
+
+	for i := 0; i < 100; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(gz)
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "id: "+strconv.Itoa(i)+"\ndata: "+strconv.Itoa(i)+"\n", readEvent(t, r))
+	}
+
+	s.publish(&Event{Data: []byte("live")})
+
+	assert.Equal(t, "id: 100\ndata: live\n", readEvent(t, r))
+}
+
+func TestStreamHandlerLaggingClientDisconnect(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	// the client stops reading, so its connection fills up and the stream
+	// blocks delivering to it
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	go func() {
+		for i := 0; i < 200; i++ {
+			s.publish(&Event{Data: data})
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 200)
+	resp.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.PublishSync(&Event{Data: []byte("after")})
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream blocked after a lagging client disconnected")
+	}
+}
+
+func BenchmarkSmallReconnectFlushes(b *testing.B) {
+	for _, limit := range []int{0, 4096} {
+		b.Run("CoalesceBytes="+strconv.Itoa(limit), func(b *testing.B) {
+			var flushes int
+
+			rec := httptest.NewRecorder()
+			c := &Connection{conn: make(chan *Event, 64), encoder: JSONEncoder}
+			ew := newEventWriter(&Stream{}, rec, func() error {
+				flushes++
+				return nil
+			}, c)
+
+			e := &Event{ID: 1, Data: []byte("ping")}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a replay of five events, followed by two live events
+				for j := 0; j < 7; j++ {
+					c.conn <- e
+				}
+
+				for len(c.conn) > 0 {
+					ew.write(<-c.conn)
+					coalesce(c, ew, limit)
+					ew.flush()
+				}
+
+				rec.Body.Reset()
+			}
+
+			b.ReportMetric(float64(flushes)/float64(b.N), "flushes/op")
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "time"
+
+// EventLogPolicy bounds a streams eventlog, see Stream.LogPolicy
+type EventLogPolicy interface {
+	// Evict is passed the eventlog, oldest event first, along with the
+	// size in bytes of its events data, and returns the number of the
+	// oldest events to drop. It is called from the streams run loop each
+	// time an event is logged, and must not modify the eventlog.
+	Evict(log EventLog, bytes int) int
+}
+
+// EventLogPolicyFunc allows a function to be used as an EventLogPolicy
+type EventLogPolicyFunc func(log EventLog, bytes int) int
+
+// Evict calls f(log, bytes)
+func (f EventLogPolicyFunc) Evict(log EventLog, bytes int) int {
+	return f(log, bytes)
+}
+
+// LogMaxEvents keeps at most n events, dropping the oldest
+func LogMaxEvents(n int) EventLogPolicy {
+	return EventLogPolicyFunc(func(log EventLog, bytes int) int {
+		if n <= 0 || len(log) <= n {
+			return 0
+		}
+		return len(log) - n
+	})
+}
+
+// LogMaxAge drops events logged more than ttl ago, going by their
+// Timestamp, stopping at the first that has not expired. As policies are
+// only applied when an event is logged, expired events are kept until the
+// next one is.
+func LogMaxAge(ttl time.Duration) EventLogPolicy {
+	return EventLogPolicyFunc(func(log EventLog, bytes int) int {
+		cutoff := time.Now().Add(-ttl)
+
+		var n int
+		for n < len(log) && log[n].Timestamp.Before(cutoff) {
+			n++
+		}
+		return n
+	})
+}
+
+// LogMaxBytes drops the oldest events until the data of those left takes
+// at most n bytes. With Stream.CompressLog, the compressed size is counted.
+func LogMaxBytes(n int) EventLogPolicy {
+	return EventLogPolicyFunc(func(log EventLog, bytes int) int {
+		var dropped int
+		for dropped < len(log) && bytes > n {
+			bytes -= len(log[dropped].Data)
+			dropped++
+		}
+		return dropped
+	})
+}
+
+// applyLogPolicy drops the events the streams MaxLogSize and LogPolicy
+// choose, always keeping the newest
+func (str *Stream) applyLogPolicy() {
+	if str.MaxLogSize > 0 && len(str.log) > str.MaxLogSize {
+		str.dropEvents(len(str.log) - str.MaxLogSize)
+	}
+
+	if str.LogPolicy != nil {
+		str.dropEvents(str.LogPolicy.Evict(str.log, str.logBytes))
+	}
+}
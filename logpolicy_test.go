@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func historyData(s *Stream) []string {
+	var data []string
+	for _, e := range s.History() {
+		data = append(data, string(e.Data))
+	}
+	return data
+}
+
+func TestStreamMaxLogSize(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.MaxLogSize = 3
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, s.PublishSync(&Event{Data: []byte(strconv.Itoa(i))}))
+	}
+
+	assert.Equal(t, []string{"2", "3", "4"}, historyData(s))
+
+	// ids continue from the newest event
+	assert.Nil(t, s.PublishSync(&Event{Data: []byte("5")}))
+	history := s.History()
+	assert.Equal(t, 5, history[len(history)-1].ID)
+}
+
+func TestStreamLogMaxAge(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.LogPolicy = LogMaxAge(time.Minute)
+
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, s.PublishSync(&Event{Data: []byte("old"), Timestamp: old}))
+
+	// the newest event is kept even once it has expired
+	assert.Equal(t, []string{"old"}, historyData(s))
+
+	assert.Nil(t, s.PublishSync(&Event{Data: []byte("new")}))
+	assert.Equal(t, []string{"new"}, historyData(s))
+}
+
+func TestStreamLogMaxBytes(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.LogPolicy = LogMaxBytes(10)
+
+	for _, data := range []string{"aaaa", "bbbb", "cccc", "dd"} {
+		assert.Nil(t, s.PublishSync(&Event{Data: []byte(data)}))
+	}
+
+	assert.Equal(t, []string{"bbbb", "cccc", "dd"}, historyData(s))
+
+	reply := make(chan LogUsage, 1)
+	s.control(logUsageReq{reply: reply})
+	assert.Equal(t, 10, (<-reply).Bytes)
+}
@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// longPollResponse is the json body returned by LongPollHandler
+type longPollResponse struct {
+	Events []jsonEvent `json:"events"`
+	Cursor int         `json:"cursor"`
+}
+
+// LongPollHandler returns a handler for clients that cannot hold a
+// streaming connection open. Each request names the id of the last event it
+// received in a cursor query parameter, and is answered with the events
+// logged after it as json, along with the cursor to send with the next
+// request. If there are none, the request waits up to timeout for the next
+// event before returning an empty list. A response holds at most as many
+// events as a connection buffers, so clients further behind catch up over
+// several requests.
+func LongPollHandler(str *Stream, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no event has been received before the first request
+		cursor := -1
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			var err error
+			cursor, err = strconv.Atoi(c)
+			if err != nil || cursor < -1 {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+
+		sub, ok := subscribeRequest(str, w, r)
+		if !ok {
+			return
+		}
+		defer sub.Close()
+
+		c := sub.connect(strconv.Itoa(cursor+1), "", ConnectionMetadata{
+			UserAgent:  r.UserAgent(),
+			RemoteAddr: r.RemoteAddr,
+		})
+		// closing the connection first releases the stream if it is blocked
+		// delivering events the response has no room for
+		defer c.close(nil)
+
+		resp := longPollResponse{Events: make([]jsonEvent, 0), Cursor: cursor}
+
+		add := func(e *Event) {
+			if e.catchUp {
+				return
+			}
+			resp.Events = append(resp.Events, newJSONEvent(e))
+			if e.hasID() && e.ID > resp.Cursor {
+				resp.Cursor = e.ID
+			}
+		}
+
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+
+	wait:
+		for len(resp.Events) == 0 {
+			select {
+			case e, ok := <-c.conn:
+				if !ok {
+					break wait
+				}
+				add(e)
+			case <-t.C:
+				break wait
+			case <-r.Context().Done():
+				return
+			case <-str.done:
+				break wait
+			}
+		}
+
+		// include any further events that are already waiting
+	drain:
+		for len(resp.Events) < cap(c.conn) {
+			select {
+			case e, ok := <-c.conn:
+				if !ok {
+					break drain
+				}
+				add(e)
+			default:
+				break drain
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
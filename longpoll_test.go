@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLongPollHandler(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	poll := func(cursor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/poll?cursor="+cursor, nil)
+		rec := httptest.NewRecorder()
+		LongPollHandler(s, time.Millisecond*200).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := poll("0")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{"events":[{"id":1,"data":"1"},{"id":2,"data":"2"}],"cursor":2}`+"\n", rec.Body.String())
+
+	start := time.Now()
+	assert.Equal(t, `{"events":[],"cursor":2}`+"\n", poll("2").Body.String())
+	assert.True(t, time.Since(start) >= time.Millisecond*200)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		s.publish(&Event{Data: []byte("3")})
+	}()
+
+	assert.Equal(t, `{"events":[{"id":3,"data":"3"}],"cursor":3}`+"\n", poll("2").Body.String())
+	assert.Equal(t, http.StatusBadRequest, poll("x").Code)
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, 0, s.SubscriberCount())
+}
+
+func TestLongPollHandlerBacklog(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 5000; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	poll := func(cursor string) longPollResponse {
+		req := httptest.NewRequest(http.MethodGet, "/poll?cursor="+cursor, nil)
+		rec := httptest.NewRecorder()
+		LongPollHandler(s, time.Millisecond*200).ServeHTTP(rec, req)
+
+		var resp longPollResponse
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// each poll returns as many events as the connection holds
+	resp := poll("")
+	assert.Len(t, resp.Events, 64)
+	assert.Equal(t, 63, resp.Cursor)
+
+	resp = poll(strconv.Itoa(resp.Cursor))
+	assert.Len(t, resp.Events, 64)
+	assert.Equal(t, 64, resp.Events[0].ID)
+
+	// the stream is not left blocked on the abandoned replays
+	done := make(chan error, 1)
+	go func() {
+		done <- s.PublishSync(&Event{Data: []byte("after")})
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream blocked after a long poll returned")
+	}
+}
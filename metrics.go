@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives operational metrics from a stream. Methods are called
+// from the streams run loop, so implementations should return quickly.
+type Metrics interface {
+	// SubscriberEvicted is called when a subscriber is evicted as a slow consumer
+	SubscriberEvicted(sub *Subscriber)
+}
+
+// DefaultBacklogInterval is how often a streams backlog is reported to its
+// BacklogMetrics, when the stream does not set a BacklogInterval
+const DefaultBacklogInterval = time.Second * 10
+
+// BacklogMetrics can be implemented by a streams Metrics to be told,
+// every BacklogInterval, how far its subscribers are behind it. The
+// values are those of StreamStats.
+type BacklogMetrics interface {
+	StreamBacklog(str *Stream, b Backlog)
+}
+
+// Backlog is how far a streams subscribers are behind it
+type Backlog struct {
+	ActiveReplays   int
+	QueuedEvents    int
+	OldestQueuedAge time.Duration
+}
+
+// backlog measures the events queued on every connection. It walks each
+// connection once, reading the length of its channel and backlog, and the
+// time its oldest event was queued, which connections record as they are
+// sent events.
+func (str *Stream) backlog() Backlog {
+	b := Backlog{ActiveReplays: int(atomic.LoadInt64(&str.activeReplays))}
+	now := time.Now()
+
+	for _, sub := range str.subscribers {
+		sub.mu.Lock()
+		for _, c := range sub.connections {
+			depth, oldest := c.queueDepth()
+			b.QueuedEvents += depth
+			if !oldest.IsZero() && now.Sub(oldest) > b.OldestQueuedAge {
+				b.OldestQueuedAge = now.Sub(oldest)
+			}
+		}
+		sub.mu.Unlock()
+	}
+
+	return b
+}
+
+// startBacklogReports starts the backlog ticker, if the streams Metrics
+// wants backlog reports and it has not already been started
+func (str *Stream) startBacklogReports() {
+	if str.backlogTicker != nil {
+		return
+	}
+	if _, ok := str.Metrics.(BacklogMetrics); !ok {
+		return
+	}
+
+	d := str.BacklogInterval
+	if d <= 0 {
+		d = DefaultBacklogInterval
+	}
+	str.backlogTicker = time.NewTicker(d)
+}
+
+// backlogReports returns the channel backlog ticks are received on, or nil
+// if no report is due
+func (str *Stream) backlogReports() <-chan time.Time {
+	if str.backlogTicker == nil {
+		return nil
+	}
+	return str.backlogTicker.C
+}
+
+// reportBacklog reports the streams backlog to its Metrics
+func (str *Stream) reportBacklog() {
+	if m, ok := str.Metrics.(BacklogMetrics); ok {
+		m.StreamBacklog(str, str.backlog())
+	}
+}
+
+// stopBacklogReports stops the backlog ticker
+func (str *Stream) stopBacklogReports() {
+	if str.backlogTicker != nil {
+		str.backlogTicker.Stop()
+		str.backlogTicker = nil
+	}
+}
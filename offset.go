@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"sync"
+)
+
+// OffsetStore persists the offset of each subscriber, the id of the event
+// after the last one it has acknowledged, so a subscriber can resume from it
+// after it reconnects or the process restarts.
+//
+// Subscribers are identified by their key, as their internal ids do not
+// outlive them. Load returns zero for a subscriber with no saved offset.
+type OffsetStore interface {
+	Save(subscriberID string, seq uint64)
+	Load(subscriberID string) (uint64, error)
+}
+
+// MemoryOffsetStore is an OffsetStore that keeps offsets in memory. It lets
+// subscribers resume across reconnects and across servers sharing it, but
+// not across process restarts.
+type MemoryOffsetStore struct {
+	offsets map[string]uint64
+	mu      sync.Mutex
+}
+
+// NewMemoryOffsetStore creates an empty in-memory offset store
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: make(map[string]uint64)}
+}
+
+// Save records the offset of a subscriber
+func (m *MemoryOffsetStore) Save(subscriberID string, seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.offsets[subscriberID] = seq
+}
+
+// Load returns the offset of a subscriber
+func (m *MemoryOffsetStore) Load(subscriberID string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.offsets[subscriberID], nil
+}
+
+// Ack records that the subscriber has processed every event up to and
+// including id, saving it to the servers Offsets. Acks for events older
+// than the last are ignored. It does nothing for subscribers without a key
+// or on servers without an OffsetStore.
+//
+// Combined with acking only after an event has been processed, this gives
+// at-least-once delivery: a subscriber that reconnects is replayed every
+// event after its last ack, including any it received but did not ack.
+// Events that have left the eventlog by then cannot be replayed.
+func (s *Subscriber) Ack(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offsets == nil || s.key == "" || id < s.acked {
+		return
+	}
+
+	s.acked = id + 1
+	s.offsets.Save(s.key, uint64(s.acked))
+}
+
+// resumeFrom returns the id a new connection should replay from. Connections
+// asking for the whole eventlog start from the subscribers saved offset
+// instead, or from the start if it cannot be loaded.
+func (s *Subscriber) resumeFrom(id string) string {
+	if id != "0" || s.offsets == nil || s.key == "" {
+		return id
+	}
+
+	seq, err := s.offsets.Load(s.key)
+	if err != nil || seq == 0 {
+		return id
+	}
+
+	if int(seq) > s.acked {
+		s.acked = int(seq)
+	}
+
+	return strconv.FormatUint(seq, 10)
+}
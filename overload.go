@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "time"
+
+// OverloadPolicy configures a breaker that sheds load from a stream whose
+// event buffer stays saturated. While tripped, the stream only delivers
+// critical events and can stop replaying its eventlog, until the buffer
+// drains.
+type OverloadPolicy struct {
+	// Fraction of the event buffer, between 0 and 1, that must be in use
+	// for the stream to count as overloaded
+	TripThreshold float64
+	// Fraction of the event buffer the backlog must fall to before the
+	// breaker resets. Keeping this below TripThreshold stops the breaker
+	// flapping around a single level.
+	ResetThreshold float64
+	// How long the stream must stay overloaded before the breaker trips
+	Window time.Duration
+	// Reports whether an event must still be delivered while tripped.
+	// Every event is dropped while tripped when this is nil.
+	Critical func(e *Event) bool
+	// Stops replaying the eventlog to new connections while tripped
+	SuspendReplay bool
+	// Called from the streams run loop whenever the breaker trips or
+	// resets, so must not block or call back into the stream
+	OnChange func(tripped bool)
+}
+
+// breaker tracks the state of a streams overload policy
+type breaker struct {
+	tripped bool
+	since   time.Time
+}
+
+// updateBreaker checks the fill level of the event buffer against the policy,
+// tripping or resetting the breaker
+func (str *Stream) updateBreaker() {
+	p := str.OverloadPolicy
+	if p == nil || cap(str.event) == 0 {
+		return
+	}
+
+	fill := float64(len(str.event)) / float64(cap(str.event))
+
+	switch {
+	case !str.breaker.tripped && fill >= p.TripThreshold:
+		if str.breaker.since.IsZero() {
+			str.breaker.since = time.Now()
+		}
+		if time.Since(str.breaker.since) >= p.Window {
+			str.setTripped(true)
+		}
+	case !str.breaker.tripped:
+		str.breaker.since = time.Time{}
+	case fill <= p.ResetThreshold:
+		str.breaker.since = time.Time{}
+		str.setTripped(false)
+	}
+}
+
+func (str *Stream) setTripped(tripped bool) {
+	str.breaker.tripped = tripped
+
+	if str.OverloadPolicy.OnChange != nil {
+		str.OverloadPolicy.OnChange(tripped)
+	}
+}
+
+// shed reports whether an event should be dropped by the breaker
+func (str *Stream) shed(e *Event) bool {
+	if !str.breaker.tripped {
+		return false
+	}
+
+	critical := str.OverloadPolicy.Critical
+	return critical == nil || !critical(e)
+}
+
+// replaySuspended reports whether the breaker has stopped replays
+func (str *Stream) replaySuspended() bool {
+	return str.breaker.tripped && str.OverloadPolicy.SuspendReplay
+}
@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamOverloadPolicy(t *testing.T) {
+	s := newStream(10)
+	defer s.close()
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	// fill the connection so the run loop blocks, then the event buffer
+	for i := 0; i < 65; i++ {
+		s.publish(&Event{Data: []byte("fill")})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	changes := make(chan bool, 10)
+	s.OverloadPolicy = &OverloadPolicy{
+		TripThreshold:  0.5,
+		ResetThreshold: 0.2,
+		Critical: func(e *Event) bool {
+			return e.Event == "alert"
+		},
+		OnChange: func(tripped bool) {
+			select {
+			case changes <- tripped:
+			default:
+			}
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		name := "routine"
+		if i%2 == 0 {
+			name = "alert"
+		}
+		s.publish(&Event{Event: name, Data: []byte(strconv.Itoa(i))})
+	}
+
+	for i := 0; i < 64; i++ {
+		<-c
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	var alerts, routine int
+	for len(c) > 0 {
+		e := <-c
+		switch e.Event {
+		case "alert":
+			alerts++
+		case "routine":
+			routine++
+		}
+	}
+
+	assert.Equal(t, 5, alerts)
+	assert.True(t, routine < 5)
+	assert.Equal(t, true, <-changes)
+	assert.Equal(t, false, <-changes)
+	assert.False(t, s.Stats().Overloaded)
+}
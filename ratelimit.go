@@ -0,0 +1,102 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitMode is what happens to events published faster than a streams
+// PublishRateLimit
+type RateLimitMode int
+
+const (
+	// RateLimitBlock makes publishers wait until the event is allowed
+	RateLimitBlock RateLimitMode = iota
+	// RateLimitReject drops the event, returning ErrRateLimited from
+	// Stream.Publish and PublishSync
+	RateLimitReject
+)
+
+// ThrottleMetrics can be implemented by a streams Metrics to be told about
+// events that were delayed or dropped by its PublishRateLimit. It is
+// called from the publishing goroutine.
+type ThrottleMetrics interface {
+	PublishThrottled(str *Stream, rejected bool)
+}
+
+// limiter is a token bucket that allows rate events a second, in bursts of
+// up to burst events
+type limiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token, returning how long to wait before it can be used.
+// Tokens are only taken if they can be used immediately or wait is true.
+func (l *limiter) reserve(rate float64, burst int, wait bool) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+
+	if !wait {
+		return 0, false
+	}
+
+	// leave the bucket in debt, so later publishers queue behind this one
+	l.tokens--
+	return time.Duration(-l.tokens / rate * float64(time.Second)), true
+}
+
+// throttle applies the streams PublishRateLimit to an event being
+// published
+func (str *Stream) throttle() error {
+	if str.PublishRateLimit <= 0 {
+		return nil
+	}
+
+	block := str.PublishRateMode == RateLimitBlock
+	delay, ok := str.limiter.reserve(str.PublishRateLimit, str.PublishBurst, block)
+	if ok && delay == 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&str.throttled, 1)
+	if m, isThrottle := str.Metrics.(ThrottleMetrics); isThrottle {
+		m.PublishThrottled(str, !ok)
+	}
+
+	if !ok {
+		return ErrRateLimited
+	}
+
+	if !str.wait(delay) {
+		return ErrStreamClosed
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type throttleCounter struct {
+	delayed, rejected int32
+}
+
+func (m *throttleCounter) SubscriberEvicted(sub *Subscriber) {}
+
+func (m *throttleCounter) PublishThrottled(str *Stream, rejected bool) {
+	if rejected {
+		atomic.AddInt32(&m.rejected, 1)
+	} else {
+		atomic.AddInt32(&m.delayed, 1)
+	}
+}
+
+func TestStreamPublishRateLimitBlock(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	m := &throttleCounter{}
+	s.Metrics = m
+	s.PublishRateLimit = 20
+	s.PublishBurst = 2
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, s.Publish(&Event{Data: []byte("ping")}))
+	}
+
+	// the burst is sent at once, then one event every 50ms
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= time.Millisecond*190, elapsed)
+	assert.True(t, elapsed < time.Millisecond*400, elapsed)
+
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Len(t, s.History(), 6)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&m.delayed))
+	assert.Equal(t, uint64(4), s.Stats().Throttled)
+}
+
+func TestStreamPublishRateLimitReject(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	m := &throttleCounter{}
+	s.Metrics = m
+	s.PublishRateLimit = 10
+	s.PublishBurst = 3
+	s.PublishRateMode = RateLimitReject
+
+	var rejected int
+	for i := 0; i < 5; i++ {
+		if s.Publish(&Event{Data: []byte("ping")}) == ErrRateLimited {
+			rejected++
+		}
+	}
+
+	assert.Equal(t, 2, rejected)
+	assert.Equal(t, ErrRateLimited, s.PublishSync(&Event{Data: []byte("ping")}))
+
+	time.Sleep(time.Millisecond * 120)
+
+	assert.Nil(t, s.Publish(&Event{Data: []byte("ping")}))
+	assert.Len(t, s.History(), 4)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&m.rejected))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&m.delayed))
+}
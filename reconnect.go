@@ -0,0 +1,121 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ReconnectTokenEvent is the name of the event StreamHandler sends a
+	// reconnection token in, see Stream.ReconnectTokenTTL
+	ReconnectTokenEvent = "_reconnect"
+	// ReconnectTokenParam is the query parameter clients present their
+	// reconnection token in. The X-Reconnect-Token header is also accepted.
+	ReconnectTokenParam = "reconnect_token"
+)
+
+// reconnectToken returns a token identifying a subscriber until it expires.
+// It is the subscriber id and expiry time, followed by an hmac of both.
+func (str *Stream) reconnectToken(sub *Subscriber) string {
+	payload := sub.id + "." + strconv.FormatInt(time.Now().Add(str.ReconnectTokenTTL).Unix(), 10)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(str.signToken(payload))
+}
+
+// parseReconnectToken returns the subscriber id held by a token, or false if
+// the token is malformed, expired or incorrectly signed
+func (str *Stream) parseReconnectToken(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, str.signToken(string(payload))) {
+		return "", false
+	}
+
+	i := strings.LastIndex(string(payload), ".")
+	if i == -1 {
+		return "", false
+	}
+
+	expiry, err := strconv.ParseInt(string(payload[i+1:]), 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+
+	return string(payload[:i]), true
+}
+
+// signToken returns the hmac of a tokens payload, with the streams
+// ReconnectSecret or the secret generated in its place
+func (str *Stream) signToken(payload string) []byte {
+	secret := str.ReconnectSecret
+	if len(secret) == 0 {
+		str.tokenSecretOnce.Do(func() {
+			str.tokenSecret = make([]byte, 32)
+			rand.Read(str.tokenSecret)
+		})
+		secret = str.tokenSecret
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// requestReconnectToken returns the reconnection token sent with a request
+func requestReconnectToken(r *http.Request) string {
+	if token := r.URL.Query().Get(ReconnectTokenParam); token != "" {
+		return token
+	}
+	return r.Header.Get("X-Reconnect-Token")
+}
+
+// takeoverReq removes a subscriber that a client is reconnecting in place
+// of, replying with the id of the last event written to any of its
+// connections
+type takeoverReq struct {
+	id    string
+	reply chan int
+}
+
+func (r takeoverReq) handle(str *Stream) {
+	i, ok := str.subscriberIndex[r.id]
+	if !ok {
+		r.reply <- -1
+		return
+	}
+
+	last := str.subscribers[i].lastSent()
+	str.removeSubscriber(i, ReasonNone)
+
+	r.reply <- last
+}
+
+// takeover removes the subscriber with the given id, returning the id of the
+// last event it was sent
+func (str *Stream) takeover(id string) int {
+	reply := make(chan int, 1)
+	if !str.control(takeoverReq{id: id, reply: reply}) {
+		return -1
+	}
+	return <-reply
+}
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectToken(t *testing.T) {
+	s := &Stream{ReconnectTokenTTL: time.Minute}
+	sub := NewSubscriber("test")
+
+	id, ok := s.parseReconnectToken(s.reconnectToken(sub))
+	assert.True(t, ok)
+	assert.Equal(t, sub.ID(), id)
+
+	// tokens are signed even without a secret, so cannot be forged
+	forged := base64.RawURLEncoding.EncodeToString([]byte(sub.ID() + ".9999999999"))
+	_, ok = s.parseReconnectToken(forged)
+	assert.False(t, ok)
+	_, ok = s.parseReconnectToken(forged + "." + forged)
+	assert.False(t, ok)
+
+	s.ReconnectSecret = []byte("secret")
+	token := s.reconnectToken(sub)
+
+	id, ok = s.parseReconnectToken(token)
+	assert.True(t, ok)
+	assert.Equal(t, sub.ID(), id)
+
+	_, ok = s.parseReconnectToken(strings.Split(token, ".")[0])
+	assert.False(t, ok)
+
+	s.ReconnectSecret = []byte("other")
+	_, ok = s.parseReconnectToken(token)
+	assert.False(t, ok)
+
+	s.ReconnectSecret = nil
+	s.ReconnectTokenTTL = -time.Minute
+	_, ok = s.parseReconnectToken(s.reconnectToken(sub))
+	assert.False(t, ok)
+}
+
+func TestStreamHandlerReconnectToken(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.ReconnectTokenTTL = time.Minute
+	s.ReconnectSecret = []byte("secret")
+
+	srv := httptest.NewServer(StreamHandler(s))
+	t.Cleanup(srv.Close)
+
+	connect := func(token string) *bufio.Reader {
+		resp, err := http.Get(srv.URL + "?" + ReconnectTokenParam + "=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body)
+	}
+
+	first := connect("")
+	frame := readEvent(t, first)
+	assert.True(t, strings.HasPrefix(frame, "event: "+ReconnectTokenEvent+"\ndata: "))
+	token := strings.TrimSuffix(strings.TrimPrefix(frame, "event: "+ReconnectTokenEvent+"\ndata: "), "\n")
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("1")})
+	s.publish(&Event{Data: []byte("2")})
+
+	assert.Equal(t, "id: 0\ndata: 1\n", readEvent(t, first))
+	assert.Equal(t, "id: 1\ndata: 2\n", readEvent(t, first))
+
+	second := connect(token)
+	readEvent(t, second)
+
+	time.Sleep(time.Millisecond * 100)
+
+	_, err := first.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, s.SubscriberCount())
+
+	s.publish(&Event{Data: []byte("3")})
+
+	assert.Equal(t, "id: 2\ndata: 3\n", readEvent(t, second))
+}
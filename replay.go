@@ -0,0 +1,228 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayModeEvent is the event type sent to connections before they are
+// replayed to, with ReplayFull or ReplayIncremental as its data, when the
+// stream has EmitReplayMode set
+const ReplayModeEvent = "_replay"
+
+// ReplayMode says how a connections replay relates to the events its
+// client already has
+type ReplayMode string
+
+const (
+	// ReplayIncremental replays only the events after the clients last
+	// event id, so the client should keep the state it has
+	ReplayIncremental ReplayMode = "incremental"
+	// ReplayFull replays the entire eventlog, so the client should discard
+	// its state first. It is used for new clients, and for clients whose
+	// last event id is newer than the eventlog, or older than events that
+	// have been evicted from it, as they may have missed events.
+	ReplayFull ReplayMode = "full"
+)
+
+// resume decides whether a connections replay can continue from its last
+// event id, or must replay the entire eventlog, and announces which.
+// Events removed by KeyFunc compaction were superseded, so do not prevent
+// an incremental replay.
+func (str *Stream) resume(conn *Connection) {
+	conn.mu.Lock()
+	start, _ := strconv.Atoi(conn.eventid)
+	last := start - 1
+
+	mode := ReplayIncremental
+	if last < 0 || last < str.evictedID || last >= str.nextID() {
+		mode = ReplayFull
+		conn.eventid = "0"
+	}
+	conn.mu.Unlock()
+
+	conn.deliver(&Event{Event: ReplayModeEvent, Data: []byte(mode)})
+}
+
+// ReplayFrom replays the events after lastEventID to a connection again, as
+// StreamHandler does for a client reconnecting with it as its Last-Event-ID.
+// The id is checked with the streams ValidateLastEventID, or EventIDs, and
+// ids that are empty or older than the eventlog replay all of it. Live
+// events are held until the replay completes.
+func (str *Stream) ReplayFrom(conn *Connection, lastEventID string) error {
+	id, err := str.validateLastEventID(lastEventID)
+	if err != nil {
+		return err
+	}
+
+	sub := conn.subscriber
+	if sub == nil {
+		return ErrSubscriberNotFound
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.replay != str.replay {
+		return ErrSubscriberNotFound
+	}
+
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return ErrConnectionNotFound
+	}
+	conn.eventid = replayStart(id)
+	conn.fingerprint = ""
+	conn.replaying = true
+	conn.mu.Unlock()
+
+	sub.requestReplay(conn)
+	return nil
+}
+
+// validateLastEventID checks a clients last event id with the streams
+// ValidateLastEventID, or its EventIDs, returning the id to replay after
+func (str *Stream) validateLastEventID(id string) (string, error) {
+	validate := str.ValidateLastEventID
+	if validate == nil && str.EventIDs != nil {
+		validate = str.EventIDs.Validate
+	}
+
+	if id == "" || validate == nil {
+		return id, nil
+	}
+	return validate(id)
+}
+
+// replayPollInterval is how often a chunked replay checks whether a
+// connection is ready for more events
+const replayPollInterval = time.Millisecond * 10
+
+// replayChunked sends events to a connection in chunks of ReplayChunkSize,
+// waiting for the connection to drain between each. Live events are held
+// on the connection until it completes, as for any other replay. When slots
+// is set, the replay waits for a place in it before starting.
+func (str *Stream) replayChunked(conn *Connection, events EventLog, slots chan struct{}) {
+	if slots != nil {
+		if !str.acquireReplay(slots) {
+			return
+		}
+		defer func() { <-slots }()
+	}
+
+	atomic.AddInt64(&str.activeReplays, 1)
+	defer atomic.AddInt64(&str.activeReplays, -1)
+
+	replayed, last := 0, -1
+
+	for len(events) > 0 {
+		n := str.ReplayChunkSize
+		if n > len(events) {
+			n = len(events)
+		}
+
+		for i := 0; i < n; {
+			ev := events[i]
+			if ev.expired(time.Now()) || !conn.wants(ev) {
+				i++
+				continue
+			}
+
+			if ev = conn.versioned(ev); ev == nil {
+				i++
+				continue
+			}
+
+			ok, closed := conn.tryDeliver(ev)
+			if closed {
+				return
+			}
+			if !ok {
+				conn.signalFlush()
+				if !str.wait(replayPollInterval) {
+					return
+				}
+				continue
+			}
+			replayed++
+			if events[i].ID > last {
+				last = events[i].ID
+			}
+			i++
+		}
+
+		events = events[n:]
+		conn.signalFlush()
+
+		if str.ReplayChunkDelay > 0 && !str.wait(str.ReplayChunkDelay) {
+			return
+		}
+
+		for !conn.drained() {
+			if !str.wait(replayPollInterval) {
+				return
+			}
+		}
+	}
+
+	str.finishReplay(conn, replayed, last)
+}
+
+// snapshot sends a connection the streams Snapshot of its eventlog,
+// returning the number of events sent and the id of the snapshot
+func (str *Stream) snapshot(conn *Connection) (int, int) {
+	log := str.replayLog(-1)
+	if len(log) == 0 {
+		return 0, -1
+	}
+
+	e := str.Snapshot(log.Copy())
+	if e == nil {
+		return 0, -1
+	}
+
+	e.ID = log[len(log)-1].ID
+	e.logged = true
+	conn.deliver(e)
+
+	return 1, e.ID
+}
+
+// acquireReplay waits for a place in slots, returning false if the stream
+// closes first
+func (str *Stream) acquireReplay(slots chan struct{}) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&str.queuedReplays, 1)
+	defer atomic.AddInt64(&str.queuedReplays, -1)
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-str.done:
+		return false
+	}
+}
+
+// wait pauses for d, returning false if the stream closes first
+func (str *Stream) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-str.done:
+		return false
+	}
+}
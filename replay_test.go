@@ -0,0 +1,126 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamChunkedReplay(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.ReplayChunkSize = 10
+	s.ReplayChunkDelay = time.Millisecond * 20
+
+	for i := 0; i < 50; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	replayed := make(chan int, 1)
+	s.OnSubscribe = func(sub *Subscriber, n int) {
+		replayed <- n
+	}
+
+	start := time.Now()
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 10)
+
+	s.publish(&Event{Data: []byte("live")})
+
+	for i := 0; i < 50; i++ {
+		e := <-c
+		assert.Equal(t, strconv.Itoa(i), string(e.Data))
+		assert.True(t, len(c) < 10)
+	}
+
+	assert.Equal(t, "live", string((<-c).Data))
+	assert.Equal(t, 50, <-replayed)
+	assert.True(t, time.Since(start) >= time.Millisecond*80)
+}
+
+func TestStreamMaxConcurrentReplays(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.ReplayChunkSize = 10
+	s.ReplayChunkDelay = time.Millisecond * 50
+	s.MaxConcurrentReplays = 1
+
+	for i := 0; i < 20; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	replayed := make(chan string, 2)
+	s.OnSubscribe = func(sub *Subscriber, n int) {
+		replayed <- sub.Key()
+	}
+
+	for _, id := range []string{"a", "b"} {
+		sub := NewSubscriber(id)
+		s.addSubscriber(sub)
+		c := sub.Connect()
+		go func() {
+			for range c {
+			}
+		}()
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.Equal(t, 1, s.Stats().QueuedReplays)
+
+	assert.Equal(t, "a", <-replayed)
+	assert.Equal(t, "b", <-replayed)
+	assert.Equal(t, 0, s.Stats().QueuedReplays)
+}
+
+func TestStreamReplayFrom(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.connect("0", "", ConnectionMetadata{})
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, s.PublishSync(&Event{Data: []byte(strconv.Itoa(i))}))
+	}
+	for i := 1; i <= 3; i++ {
+		<-c.conn
+	}
+
+	// only the events after the given id are sent again
+	assert.Nil(t, s.ReplayFrom(c, "0"))
+	for _, want := range []int{1, 2} {
+		e := <-c.conn
+		assert.Equal(t, want, e.ID)
+	}
+
+	// an unknown id replays everything
+	assert.Nil(t, s.ReplayFrom(c, ""))
+	for _, want := range []int{0, 1, 2} {
+		e := <-c.conn
+		assert.Equal(t, want, e.ID)
+	}
+
+	s.EventIDs = NewIDGenerator("orders")
+	assert.Equal(t, ErrForeignEventID, s.ReplayFrom(c, "users-1"))
+
+	other := newStream(DefaultBufferSize)
+	defer other.close()
+	assert.Equal(t, ErrSubscriberNotFound, other.ReplayFrom(c, "1"))
+}
@@ -5,7 +5,10 @@
 package broadcast
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,7 +26,39 @@ type Server struct {
 	// Enables creation of a stream when a client connects
 	AutoStream bool
 	Streams    map[string]*Stream
-	mu         sync.Mutex
+	// Called with every event published to any of the servers streams,
+	// as Stream.Tap is, along with the id of the stream
+	Tap func(streamID string, e *Event)
+	// Settings applied to every stream the server creates. A setting made
+	// on a stream after it is created takes precedence over these, and
+	// these over the streams own defaults.
+	DefaultStreamConfig StreamConfig
+	// Saves the offsets subscribers acknowledge with Subscriber.Ack, and
+	// resumes their new connections from them. Only streams created after
+	// it is set use it. Disabled when nil.
+	Offsets OffsetStore
+	// alternative ids for streams, see AddAlias
+	aliases map[string]string
+	// Limits the combined size in bytes of every streams eventlog. When
+	// exceeded, events are evicted from the stream chosen by the
+	// EvictionPolicy, which defaults to EvictLargestLog. Each stream always
+	// keeps its newest event. Zero means unlimited.
+	MaxTotalLogBytes int64
+	EvictionPolicy   EvictionPolicy
+	// Limits the number of subscribers across every stream. Subscribing
+	// beyond it fails with ErrTooManySubscribers, which StreamHandler
+	// answers with 503 Service Unavailable. Zero means unlimited.
+	MaxTotalSubscribers int
+	subscriberCount     int64
+	logBytes            int64
+	evictOnce           sync.Once
+	evictSignal         chan struct{}
+	draining            bool
+	mu                  sync.Mutex
+	// closed by Close to stop the servers goroutines
+	stop      chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
 }
 
 // New will create a server and setup defaults
@@ -35,37 +70,119 @@ func New() *Server {
 	}
 }
 
-// Close shuts down the server, closes all of the streams and connections
+// Close shuts down the server, closes all of the streams and connections.
+// Streams are closed one at a time, highest ShutdownPriority first, with
+// streams of equal priority closed in order of id. Each has finished
+// closing before the next starts, so streams that are fed by others can be
+// given a higher priority to be closed before their sources.
 func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stopped())
+	})
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	ids := make([]string, 0, len(s.Streams))
 	for id := range s.Streams {
-		s.Streams[id].quit <- true
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := s.Streams[ids[i]], s.Streams[ids[j]]
+		if a.ShutdownPriority != b.ShutdownPriority {
+			return a.ShutdownPriority > b.ShutdownPriority
+		}
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		str := s.Streams[id]
+		str.close()
+		<-str.done
 		delete(s.Streams, id)
 	}
 }
 
+// stopped returns the channel closed once the server is closed
+func (s *Server) stopped() chan struct{} {
+	s.stopOnce.Do(func() {
+		s.stop = make(chan struct{})
+	})
+	return s.stop
+}
+
 // GetStream returns a stream by id
 func (s *Server) GetStream(id string) *Stream {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.Streams[id]
+	return s.Streams[s.resolve(id)]
 }
 
 // CreateStream will create a new stream and register it
 func (s *Server) CreateStream(id string) *Stream {
+	return s.CreateStreamWithConfig(id, StreamConfig{})
+}
+
+// CreateStreamWithConfig creates a stream like CreateStream, applying any
+// settings in cfg over the servers DefaultStreamConfig. If the stream
+// already exists it is returned unchanged.
+func (s *Server) CreateStreamWithConfig(id string, cfg StreamConfig) *Stream {
 	// Register new stream
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	id = s.resolve(id)
 	if s.Streams[id] != nil {
 		return s.Streams[id]
 	}
 
-	s.Streams[id] = newStream(s.BufferSize)
+	str := newConfiguredStream(s.BufferSize, s.DefaultStreamConfig)
+	str.apply(cfg)
+	str.SetDraining(s.draining)
+	str.onLogResize = s.resizeLog
+	str.offsets = s.Offsets
+	str.reserveSubscriber = s.reserveSubscriber
+	str.releaseSubscriber = s.releaseSubscriber
+	str.serverTap = func(e *Event) {
+		if s.Tap != nil {
+			s.Tap(id, e)
+		}
+	}
+	// forget streams that close themselves after MaxInactivity
+	str.onClose = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.Streams[id] == str {
+			delete(s.Streams, id)
+		}
+	}
+
+	s.Streams[id] = str
+	str.run()
+
+	return str
+}
+
+// CreateStreamWithContext creates a stream like CreateStream, that is also
+// closed when ctx is done. Closing it disconnects its subscribers and
+// removes it from the server, as RemoveStream would. Whichever of ctx,
+// RemoveStream or the streams MaxInactivity closes it first wins. If the
+// stream already exists, it is returned and bound to ctx as well.
+func (s *Server) CreateStreamWithContext(ctx context.Context, id string) *Stream {
+	str := s.CreateStream(id)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// onClose removes the stream from the server
+			str.close()
+		case <-str.done:
+		}
+	}()
 
-	return s.Streams[id]
+	return str
 }
 
 // RemoveStream will remove a stream
@@ -73,45 +190,190 @@ func (s *Server) RemoveStream(id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	id = s.resolve(id)
 	if s.Streams[id] != nil {
 		s.Streams[id].close()
 		delete(s.Streams, id)
 	}
 }
 
+// MigrateSubscribers moves every subscriber on one stream to another,
+// without closing their connections. Subscribers stop receiving events
+// from the first stream once they have been removed from it, and start
+// receiving events from the second once they are registered on it. If
+// replay is true, the second streams eventlog is replayed to them.
+func (s *Server) MigrateSubscribers(from, to string, replay bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, dst := s.Streams[s.resolve(from)], s.Streams[s.resolve(to)]
+	if src == nil || dst == nil {
+		return ErrStreamNotFound
+	}
+
+	if src == dst {
+		return nil
+	}
+
+	reply := make(chan []*Subscriber, 1)
+	if !src.control(detachReq{reply: reply}) {
+		return ErrStreamClosed
+	}
+
+	for _, sub := range <-reply {
+		if err := dst.addSubscriber(sub); err != nil {
+			reason := ReasonShutdown
+			if err == ErrStreamDraining {
+				reason = ReasonDraining
+			}
+			sub.DisconnectAllWithReason(reason)
+			continue
+		}
+
+		if replay {
+			sub.Replay()
+		}
+	}
+
+	return nil
+}
+
+// AllStats returns a snapshot of the stats of every stream on the server,
+// keyed by stream id. Streams that close while the snapshot is taken are
+// left out.
+func (s *Server) AllStats() map[string]StreamStats {
+	streams := s.snapshotStreams()
+	stats := make(map[string]StreamStats, len(streams))
+
+	for id, str := range streams {
+		if st, ok := str.stats(); ok {
+			stats[id] = st
+		}
+	}
+
+	return stats
+}
+
+// reserveSubscriber takes a place for a new subscriber, returning false if
+// the server already has MaxTotalSubscribers
+func (s *Server) reserveSubscriber() bool {
+	if atomic.AddInt64(&s.subscriberCount, 1) > int64(s.MaxTotalSubscribers) && s.MaxTotalSubscribers > 0 {
+		atomic.AddInt64(&s.subscriberCount, -1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) releaseSubscriber(n int) {
+	atomic.AddInt64(&s.subscriberCount, -int64(n))
+}
+
 // StreamExists checks whether a stream by a given id exists
 func (s *Server) StreamExists(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.Streams[id] != nil
+	return s.Streams[s.resolve(id)] != nil
 }
 
 // Publish sends a mesage to every client in a streamID
 func (s *Server) Publish(id string, data []byte) {
+	s.PublishWithPriority(id, data, PriorityNormal)
+}
+
+// PublishWithPriority sends a message to every client in a streamID, ahead
+// of any queued messages with a lower priority
+func (s *Server) PublishWithPriority(id string, data []byte, p Priority) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.Streams[id] != nil {
-		s.Streams[id].event <- &Event{Data: data}
+	if str := s.Streams[s.resolve(id)]; str != nil {
+		str.publishPriority(&Event{Data: data}, p)
 	}
 }
 
 // Register a subscriber
-func (s *Server) Register(id string, sub *Subscriber) {
+func (s *Server) Register(id string, sub *Subscriber) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Streams[s.resolve(id)].addSubscriber(sub)
+}
+
+// SubscribeWithContext subscribes to a stream until ctx is done, returning
+// the channel its events are delivered on. Once ctx is done the subscriber
+// is removed from the stream and the channel is closed, as it is if the
+// stream closes first. The stream is created if it does not exist and the
+// server has AutoStream set, otherwise ErrStreamNotFound is returned. If
+// ctx is already done, nothing is subscribed and its error is returned.
+func (s *Server) SubscribeWithContext(ctx context.Context, streamID string) (chan *Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	str := s.GetStream(streamID)
+	if str == nil && s.AutoStream {
+		str = s.CreateStream(streamID)
+	}
+	if str == nil {
+		return nil, ErrStreamNotFound
+	}
+
+	sub := NewSubscriber("")
+	if err := str.addSubscriber(sub); err != nil {
+		return nil, err
+	}
+	c := sub.connect("0", "", ConnectionMetadata{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the caller may have stopped reading, so close the connection
+			// before deregistering in case the stream is blocked on it
+			c.close(nil)
+			sub.Close()
+		case <-str.done:
+		}
+	}()
+
+	return c.conn, nil
+}
+
+// SetDraining sets whether every stream on the server, including any
+// created later, is draining. See Stream.SetDraining.
+func (s *Server) SetDraining(draining bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.Streams[id].addSubscriber(sub)
+	s.draining = draining
+	for id := range s.Streams {
+		s.Streams[id].SetDraining(draining)
+	}
+}
+
+// Drain sets the server draining and waits for the subscribers of every
+// stream to disconnect, disconnecting any left once ctx is done. See
+// Stream.Drain.
+func (s *Server) Drain(ctx context.Context) error {
+	s.SetDraining(true)
+
+	var err error
+	for _, str := range s.snapshotStreams() {
+		if serr := str.Drain(ctx); serr != nil {
+			err = serr
+		}
+	}
+
+	return err
 }
 
-// GetSubscriber will get an existing subscriber
-func (s *Server) GetSubscriber(id string) *Subscriber {
+// GetSubscriber will get an existing subscriber by its key
+func (s *Server) GetSubscriber(key string) *Subscriber {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, stream := range s.Streams {
-		sub := stream.getSubscriber(id)
+		sub := stream.getSubscriber(key)
 		if sub != nil {
 			return sub
 		}
@@ -120,14 +382,15 @@ func (s *Server) GetSubscriber(id string) *Subscriber {
 	return nil
 }
 
-// GetStreamSubscriber will get an existing stream subscriber
-func (s *Server) GetStreamSubscriber(stream, id string) *Subscriber {
+// GetStreamSubscriber will get an existing stream subscriber by its key
+func (s *Server) GetStreamSubscriber(stream, key string) *Subscriber {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.Streams[stream] == nil {
+	str := s.Streams[s.resolve(stream)]
+	if str == nil {
 		return nil
 	}
 
-	return s.Streams[stream].getSubscriber(id)
+	return str.getSubscriber(key)
 }
@@ -0,0 +1,622 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMigrateSubscribers(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	a := s.CreateStream("a")
+	b := s.CreateStream("b")
+
+	conns := make([]chan *Event, 5)
+	for i := range conns {
+		sub := NewSubscriber(strconv.Itoa(i))
+		s.Register("a", sub)
+		conns[i] = sub.Connect()
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Publish("a", []byte("a"))
+			s.Publish("b", []byte("b"))
+			time.Sleep(time.Millisecond * 5)
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+
+	assert.NoError(t, s.MigrateSubscribers("a", "b", false))
+
+	time.Sleep(time.Millisecond * 50)
+	close(stop)
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Equal(t, 0, a.SubscriberCount())
+	assert.Equal(t, 5, b.SubscriberCount())
+
+	for _, c := range conns {
+		var seenB bool
+		for len(c) > 0 {
+			e, ok := <-c
+			assert.True(t, ok)
+			if string(e.Data) == "b" {
+				seenB = true
+			} else {
+				assert.False(t, seenB, "received an event from a after migrating to b")
+			}
+		}
+		assert.True(t, seenB)
+	}
+
+	assert.Equal(t, ErrStreamNotFound, s.MigrateSubscribers("a", "c", false))
+}
+
+func TestServerMaxTotalLogBytes(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	s.MaxTotalLogBytes = 20
+
+	a := s.CreateStream("a")
+	b := s.CreateStream("b")
+
+	for i := 0; i < 10; i++ {
+		s.Publish("a", []byte("aaaa"))
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.Publish("b", []byte("bbbb"))
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Len(t, a.History(), 4)
+	assert.Len(t, b.History(), 1)
+	assert.Equal(t, 9, a.History()[3].ID)
+
+	s.EvictionPolicy = EvictOldestEvent
+	s.Publish("b", []byte("bbbb"))
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Len(t, a.History(), 3)
+	assert.Len(t, b.History(), 2)
+}
+
+func TestServerCloseStopsEviction(t *testing.T) {
+	s := New()
+
+	done := make(chan struct{})
+	go func() {
+		s.evictLogs(make(chan struct{}), s.stopped())
+		close(done)
+	}()
+
+	s.Close()
+	s.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("eviction did not stop")
+	}
+}
+
+func TestServerAllStats(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	s.CreateStream("a")
+	s.CreateStream("b")
+	s.CreateStream("c").close()
+
+	s.Publish("a", []byte("ping"))
+	s.Register("b", NewSubscriber("test"))
+
+	time.Sleep(time.Millisecond * 100)
+
+	stats := s.AllStats()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, 1, stats["a"].LogSize)
+	assert.Equal(t, 1, stats["b"].Subscribers)
+	assert.True(t, stats["a"].UntilReap > 0)
+}
+
+func TestServerPublishWithPriority(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	s.CreateStream("test")
+
+	sub := NewSubscriber("test")
+	s.Register("test", sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	// fill the connection so the run loop blocks, leaving events queued
+	for i := 0; i < 65; i++ {
+		s.Publish("test", []byte("fill"))
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 5; i++ {
+		s.Publish("test", []byte("routine"))
+	}
+	s.PublishWithPriority("test", []byte("alert"), PriorityHigh)
+
+	for i := 0; i < 65; i++ {
+		assert.Equal(t, "fill", string((<-c).Data))
+	}
+
+	assert.Equal(t, "alert", string((<-c).Data))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "routine", string((<-c).Data))
+	}
+}
+
+func TestServerPrunesInactiveStreams(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	str := s.CreateStream("test")
+	str.MaxInactivity = time.Millisecond * 100
+
+	// resets the inactivity timer with the new duration
+	s.Publish("test", []byte("ping"))
+
+	time.Sleep(time.Millisecond * 300)
+
+	assert.True(t, str.closed)
+	assert.False(t, s.StreamExists("test"))
+	assert.Nil(t, s.GetStream("test"))
+}
+
+func TestServerMaxTotalSubscribers(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	s.MaxTotalSubscribers = 3
+
+	s.CreateStream("a")
+	b := s.CreateStream("b")
+
+	first := NewSubscriber("1")
+	assert.Nil(t, s.Register("a", first))
+	assert.Nil(t, s.Register("a", NewSubscriber("2")))
+	assert.Nil(t, s.Register("b", NewSubscriber("3")))
+	assert.Equal(t, ErrTooManySubscribers, s.Register("b", NewSubscriber("4")))
+
+	rec := httptest.NewRecorder()
+	StreamHandler(b).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	first.Close()
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Nil(t, s.Register("b", NewSubscriber("4")))
+}
+
+func TestServerAddAlias(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	str := s.CreateStream("orders")
+	s.CreateStream("users")
+
+	assert.Equal(t, ErrInvalidAlias, s.AddAlias("users", "orders"))
+	assert.Equal(t, ErrInvalidAlias, s.AddAlias("orders", "orders"))
+
+	assert.Nil(t, s.AddAlias("legacy-orders", "orders"))
+	assert.Nil(t, s.AddAlias("v1-orders", "legacy-orders"))
+	assert.Equal(t, ErrInvalidAlias, s.AddAlias("orders", "v1-orders"))
+
+	assert.Equal(t, str, s.GetStream("legacy-orders"))
+	assert.Equal(t, str, s.GetStream("v1-orders"))
+	assert.Equal(t, str, s.CreateStream("legacy-orders"))
+	assert.Len(t, s.Streams, 2)
+
+	s.Publish("orders", []byte("1"))
+	s.Publish("legacy-orders", []byte("2"))
+
+	time.Sleep(time.Millisecond * 100)
+
+	// a client reconnecting to the old id resumes from the new stream
+	sub := NewSubscriber("test")
+	assert.Nil(t, s.Register("legacy-orders", sub))
+	c := sub.ConnectAtID("1")
+
+	assert.Equal(t, "2", string((<-c).Data))
+	assert.Equal(t, sub, s.GetStreamSubscriber("v1-orders", "test"))
+
+	s.RemoveAlias("legacy-orders")
+	assert.False(t, s.StreamExists("legacy-orders"))
+	assert.True(t, s.StreamExists("v1-orders"))
+}
+
+func TestServerDefaultStreamConfig(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	catchUp := &Event{Event: DefaultCatchUpEvent}
+	s.DefaultStreamConfig = StreamConfig{
+		KeepAlive:            time.Second * 15,
+		MaxInactivity:        time.Minute * 5,
+		CatchUpCompleteEvent: catchUp,
+	}
+
+	str := s.CreateStream("a")
+	assert.Equal(t, time.Second*15, str.KeepAlive)
+	assert.Equal(t, time.Minute*5, str.MaxInactivity)
+	assert.Equal(t, time.Duration(0), str.RetryInterval)
+	assert.Equal(t, catchUp, str.CatchUpCompleteEvent)
+
+	// settings on the stream take precedence
+	str.KeepAlive = time.Second * 30
+	assert.Equal(t, str, s.CreateStream("a"))
+	assert.Equal(t, time.Second*30, str.KeepAlive)
+
+	plain := newStream(DefaultBufferSize)
+	defer plain.close()
+	assert.Equal(t, DefaultMaxInactivity, plain.MaxInactivity)
+	assert.Nil(t, plain.CatchUpCompleteEvent)
+}
+
+func TestServerCreateStreamWithContext(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	str := s.CreateStreamWithContext(ctx, "session")
+	sub := NewSubscriber("test")
+	assert.Nil(t, s.Register("session", sub))
+	c := sub.Connect()
+
+	cancel()
+
+	_, ok := <-c
+	assert.False(t, ok)
+
+	<-str.Done()
+	time.Sleep(time.Millisecond * 10)
+
+	assert.False(t, s.StreamExists("session"))
+
+	// a stream that closes itself first is left alone by the context
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	str = s.CreateStreamWithContext(ctx, "session")
+	s.RemoveStream("session")
+	replacement := s.CreateStream("session")
+	cancel()
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, replacement, s.GetStream("session"))
+	select {
+	case <-replacement.Done():
+		t.Fatal("replacement stream was closed")
+	default:
+	}
+}
+
+func TestServerSubscribeWithContext(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	_, err := s.SubscribeWithContext(context.Background(), "missing")
+	assert.Equal(t, ErrStreamNotFound, err)
+
+	str := s.CreateStream("test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := s.SubscribeWithContext(ctx, "test")
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 50)
+
+	str.publish(&Event{Data: []byte("hello")})
+	e := <-c
+	assert.Equal(t, "hello", string(e.Data))
+
+	cancel()
+
+	_, ok := <-c
+	assert.False(t, ok)
+
+	time.Sleep(time.Millisecond * 10)
+	assert.Equal(t, 0, str.SubscriberCount())
+
+	// nothing is subscribed for a context that is already done
+	_, err = s.SubscribeWithContext(ctx, "test")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, str.SubscriberCount())
+
+	// a caller that stopped reading does not block the stream once its
+	// context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = s.SubscribeWithContext(ctx, "test")
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 50)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			str.publish(&Event{Data: []byte("ignored")})
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- str.PublishSync(&Event{Data: []byte("after")})
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream blocked after the context was done")
+	}
+
+	// streams are created on demand with AutoStream
+	s.AutoStream = true
+	_, err = s.SubscribeWithContext(context.Background(), "auto")
+	assert.Nil(t, err)
+	assert.True(t, s.StreamExists("auto"))
+}
+
+func TestServerSeedStream(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	str := s.CreateStreamWithConfig("state", StreamConfig{
+		Seed: func() ([]*Event, error) {
+			time.Sleep(time.Millisecond * 50)
+			return []*Event{{Data: []byte("a")}, {Data: []byte("b")}}, nil
+		},
+	})
+
+	// the first subscriber is replayed the seeded events
+	sub := NewSubscriber("test")
+	assert.Nil(t, s.Register("state", sub))
+	c := sub.Connect()
+
+	assert.Equal(t, 0, (<-c).ID)
+	assert.Equal(t, "b", string((<-c).Data))
+
+	s.Publish("state", []byte("c"))
+	assert.Equal(t, 2, (<-c).ID)
+	assert.Len(t, str.History(), 3)
+
+	errs := make(chan error, 1)
+	failed := s.CreateStreamWithConfig("failed", StreamConfig{
+		OnError: func(err error) {
+			errs <- err
+		},
+		Seed: func() ([]*Event, error) {
+			panic("database unavailable")
+		},
+	})
+
+	assert.Equal(t, "broadcast: seeding stream: panic: database unavailable", (<-errs).Error())
+	assert.Len(t, failed.History(), 0)
+}
+
+func TestServerTap(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	var mu sync.Mutex
+	tapped := make(map[string][]string)
+	s.Tap = func(streamID string, e *Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		tapped[streamID] = append(tapped[streamID], string(e.Data))
+	}
+
+	a := s.CreateStream("a")
+	s.CreateStream("b")
+
+	var own int32
+	a.Tap = func(e *Event) {
+		atomic.AddInt32(&own, 1)
+	}
+
+	// events are tapped whether or not anyone receives them
+	sub := NewSubscriberWithOptions("filtered", SubscriberOptions{
+		Filter: func(e *Event) bool { return false },
+	})
+	assert.Nil(t, s.Register("a", sub))
+	sub.Connect()
+
+	s.Publish("a", []byte("1"))
+	s.Publish("b", []byte("2"))
+	s.Publish("a", []byte("3"))
+	a.PublishWhere(func(*Subscriber) bool { return false }, &Event{Data: []byte("4")})
+
+	time.Sleep(time.Millisecond * 100)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"1", "3", "4"}, tapped["a"])
+	assert.Equal(t, []string{"2"}, tapped["b"])
+	assert.Equal(t, int32(3), atomic.LoadInt32(&own))
+}
+
+func TestServerCloseOrder(t *testing.T) {
+	s := New()
+
+	var mu sync.Mutex
+	var closed []string
+
+	for _, id := range []string{"raw", "derived", "aggregate", "other"} {
+		p := map[string]int{"derived": 1, "aggregate": 2}[id]
+		str := s.CreateStreamWithConfig(id, StreamConfig{ShutdownPriority: p})
+
+		// record the order streams finish closing in, as they do
+		id, onClose := id, str.onClose
+		str.onClose = func() {
+			mu.Lock()
+			closed = append(closed, id)
+			mu.Unlock()
+			onClose()
+		}
+	}
+
+	s.Close()
+
+	time.Sleep(time.Millisecond * 10)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"aggregate", "derived", "other", "raw"}, closed)
+	assert.Len(t, s.Streams, 0)
+}
+
+func TestServerOffsets(t *testing.T) {
+	store := NewMemoryOffsetStore()
+	seed := StreamConfig{Seed: func() ([]*Event, error) {
+		events := make([]*Event, 5)
+		for i := range events {
+			events[i] = &Event{Data: []byte(strconv.Itoa(i + 1))}
+		}
+		return events, nil
+	}}
+
+	s := New()
+	s.Offsets = store
+	s.CreateStreamWithConfig("orders", seed)
+
+	sub := NewSubscriber("alice")
+	assert.Nil(t, s.Register("orders", sub))
+	c := sub.Connect()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, i, (<-c).ID)
+		sub.Ack(i)
+	}
+	// acks that go backwards are ignored
+	sub.Ack(0)
+	s.Close()
+
+	seq, err := store.Load("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), seq)
+
+	// a restarted server resumes after the last ack
+	s = New()
+	defer s.Close()
+	s.Offsets = store
+	s.CreateStreamWithConfig("orders", seed)
+
+	sub = NewSubscriber("alice")
+	assert.Nil(t, s.Register("orders", sub))
+	c = sub.Connect()
+
+	assert.Equal(t, 3, (<-c).ID)
+	assert.Equal(t, 4, (<-c).ID)
+
+	// subscribers without a saved offset are replayed everything
+	bob := NewSubscriber("bob")
+	assert.Nil(t, s.Register("orders", bob))
+	assert.Equal(t, 0, (<-bob.Connect()).ID)
+}
+
+func TestServerImportStream(t *testing.T) {
+	src := New()
+	defer src.Close()
+
+	str := src.CreateStream("orders")
+	str.CompressLog = true
+	for i := 1; i <= 5; i++ {
+		str.publish(&Event{Event: "order", Data: []byte(strconv.Itoa(i)), Fields: map[string]string{"n": strconv.Itoa(i)}})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	data := str.Export()
+
+	dst := New()
+	defer dst.Close()
+
+	imported, err := dst.ImportStream("orders", data)
+	assert.Nil(t, err)
+	assert.Equal(t, data, imported.Export())
+
+	// a client reconnecting after event 2 is replayed the rest
+	sub := NewSubscriber("test")
+	assert.Nil(t, dst.Register("orders", sub))
+	c := sub.ConnectAtID(replayStart("2"))
+
+	e := <-c
+	assert.Equal(t, 3, e.ID)
+	assert.Equal(t, "4", string(e.Data))
+	assert.Equal(t, "4", e.Fields["n"])
+	assert.Equal(t, "5", string((<-c).Data))
+
+	imported.publish(&Event{Data: []byte("new")})
+	e = <-c
+	assert.Equal(t, 5, e.ID)
+	assert.Equal(t, "new", string(e.Data))
+
+	_, err = dst.ImportStream("bad", []byte(`{"format":99}`))
+	assert.Equal(t, ErrInvalidExport, err)
+	_, err = dst.ImportStream("bad", []byte(`{"format":1,"events":[{"id":2},{"id":1}]}`))
+	assert.Equal(t, ErrInvalidExport, err)
+}
+
+func TestServerImportStreamNextID(t *testing.T) {
+	src := New()
+	defer src.Close()
+
+	str := src.CreateStream("orders")
+	for i := 1; i <= 3; i++ {
+		str.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	str.ResetLog()
+	data := str.Export()
+
+	dst := New()
+	defer dst.Close()
+
+	imported, err := dst.ImportStream("orders", data)
+	assert.Nil(t, err)
+
+	// ids of the events evicted before the export are not reused
+	sub := NewSubscriber("test")
+	assert.Nil(t, dst.Register("orders", sub))
+	c := sub.Connect()
+
+	imported.publish(&Event{Data: []byte("new")})
+	assert.Equal(t, 3, (<-c).ID)
+}
@@ -0,0 +1,270 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventWriter writes events to a http response in the server-sent events
+// format. Events are buffered until flush is called.
+type eventWriter struct {
+	w       *bufio.Writer
+	gz      *gzip.Writer
+	flusher func() error
+	conn    *Connection
+	encoder Encoder
+	// formats event ids, see Stream.EventIDs
+	ids *IDGenerator
+	// writes and reports queue waits, see Stream.MeasureLatency
+	measureLatency bool
+	onQueueWait    func(c *Connection, e *Event, wait time.Duration)
+	// decides what happens to events that fail to encode
+	onEncodeError func(err error, e *Event, c *Connection) EncodeErrorAction
+	// when set, event timestamps are written to this field
+	timestampField  string
+	timestampFormat string
+	lineEnding      string
+	eventEnding     string
+}
+
+func newEventWriter(str *Stream, w http.ResponseWriter, flusher func() error, c *Connection) *eventWriter {
+	ew := &eventWriter{
+		w:              bufio.NewWriter(w),
+		flusher:        flusher,
+		conn:           c,
+		encoder:        c.encoder,
+		ids:            str.EventIDs,
+		onEncodeError:  str.OnEncodeError,
+		measureLatency: str.MeasureLatency,
+		onQueueWait:    str.OnQueueWait,
+		lineEnding:     str.Framing.LineEnding,
+		eventEnding:    str.Framing.EventEnding,
+	}
+
+	if ew.lineEnding == "" {
+		ew.lineEnding = "\n"
+	}
+
+	if ew.eventEnding == "" {
+		ew.eventEnding = ew.lineEnding
+	}
+
+	if str.Framing.NoEventEnding {
+		ew.eventEnding = ""
+	}
+
+	if str.EmitTimestamp {
+		ew.timestampField = str.TimestampField
+		ew.timestampFormat = str.TimestampFormat
+	}
+
+	return ew
+}
+
+// write encodes and buffers an event. An error is returned if the
+// connection should be closed.
+func (ew *eventWriter) write(e *Event) error {
+	if e.isDropped() {
+		return nil
+	}
+
+	wait := ew.queueWait(e)
+
+	data, err := ew.encoder.Encode(e)
+	if err != nil {
+		if ew.onEncodeError == nil {
+			return nil
+		}
+
+		switch ew.onEncodeError(err, e, ew.conn) {
+		case EncodeErrorDrop:
+			e.drop()
+		case EncodeErrorDisconnect:
+			return err
+		}
+
+		return nil
+	}
+
+	if err := ew.writeEvent(e, data, wait); err != nil {
+		return err
+	}
+
+	if ew.conn != nil && e.hasID() {
+		ew.conn.sent(e.ID)
+	}
+
+	return nil
+}
+
+// compress gzips everything written from now on to out
+func (ew *eventWriter) compress(out io.Writer) {
+	ew.gz = gzip.NewWriter(out)
+	ew.w = bufio.NewWriter(ew.gz)
+}
+
+// close ends a compressed response
+func (ew *eventWriter) close() error {
+	if ew.gz == nil {
+		return nil
+	}
+	if err := ew.w.Flush(); err != nil {
+		return err
+	}
+	return ew.gz.Close()
+}
+
+// flush sends any buffered events to the client
+func (ew *eventWriter) flush() error {
+	if err := ew.w.Flush(); err != nil {
+		return err
+	}
+
+	if ew.gz != nil {
+		if err := ew.gz.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return ew.flusher()
+}
+
+// writeEvent writes an event in the server-sent events format, using data
+// as the events encoded data
+func (ew *eventWriter) writeEvent(e *Event, data []byte, wait time.Duration) error {
+	if e.hasID() && ew.ids != nil {
+		ew.writeField("id", ew.ids.Format(e.ID))
+	} else if e.hasID() {
+		ew.writeField("id", strconv.Itoa(e.ID))
+	}
+
+	if e.Event != "" {
+		ew.writeField("event", e.Event)
+	}
+
+	if ew.timestampField != "" && !e.Timestamp.IsZero() {
+		ew.writeField(ew.timestampField, ew.formatTimestamp(e.Timestamp))
+	}
+
+	if wait > 0 {
+		ew.writeField(QueueWaitField, wait.String())
+	}
+
+	if len(e.Fields) > 0 {
+		ew.writeExtraFields(e.Fields)
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		ew.w.WriteString("data: ")
+		ew.w.Write(bytes.TrimSuffix(line, []byte("\r")))
+		ew.w.WriteString(ew.lineEnding)
+	}
+
+	_, err := ew.w.WriteString(ew.eventEnding)
+
+	return err
+}
+
+// writeRetry writes the sse retry field, telling the client how long to
+// wait before reconnecting
+func (ew *eventWriter) writeRetry(d time.Duration) error {
+	ew.writeField("retry", strconv.FormatInt(int64(d/time.Millisecond), 10))
+	_, err := ew.w.WriteString(ew.eventEnding)
+	return err
+}
+
+// PaddingPreamble returns an sse comment followed by a blank line, n bytes
+// long in total, for use as a Stream.Preamble. 2048 bytes is enough for
+// most buffering proxies.
+func PaddingPreamble(n int) []byte {
+	if n < 3 {
+		n = 3
+	}
+
+	b := bytes.Repeat([]byte(":"), n)
+	b[n-2], b[n-1] = '\n', '\n'
+	return b
+}
+
+// writeComment writes an sse comment, which clients ignore
+func (ew *eventWriter) writeComment(text string) error {
+	ew.w.WriteString(": ")
+	ew.w.WriteString(text)
+	ew.w.WriteString(ew.lineEnding)
+	_, err := ew.w.WriteString(ew.eventEnding)
+	return err
+}
+
+// queueWait returns how long a live event waited before the writer started
+// sending it, or zero if it is not measured
+func (ew *eventWriter) queueWait(e *Event) time.Duration {
+	if !ew.measureLatency || e.received.IsZero() || ew.conn == nil {
+		return 0
+	}
+
+	// events handled before the connection was made are being replayed
+	if e.received.Before(ew.conn.Timing().RegisteredAt) {
+		return 0
+	}
+
+	wait := time.Since(e.received)
+	if ew.onQueueWait != nil {
+		ew.onQueueWait(ew.conn, e, wait)
+	}
+
+	return wait
+}
+
+// writeExtraFields writes an events extra fields sorted by name, skipping
+// any that would replace a standard field or break the framing
+func (ew *eventWriter) writeExtraFields(fields map[string]string) {
+	for _, name := range extraFieldNames(fields, ew.timestampField) {
+		ew.writeField(name, fields[name])
+	}
+}
+
+// extraFieldNames returns the names of the extra fields that are written,
+// sorted by name
+func extraFieldNames(fields map[string]string, timestampField string) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		switch name {
+		case "", "id", "event", "data", "retry", timestampField, QueueWaitField:
+			continue
+		}
+		if strings.ContainsAny(name, ":\r\n") || strings.ContainsAny(fields[name], "\r\n") {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// writeField writes a single "name: value" line
+func (ew *eventWriter) writeField(name, value string) {
+	ew.w.WriteString(name)
+	ew.w.WriteString(": ")
+	ew.w.WriteString(value)
+	ew.w.WriteString(ew.lineEnding)
+}
+
+func (ew *eventWriter) formatTimestamp(t time.Time) string {
+	if ew.timestampFormat == "" {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return t.Format(ew.timestampFormat)
+}
@@ -0,0 +1,166 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestEvent(str *Stream, e *Event) string {
+	rec := httptest.NewRecorder()
+	ew := newEventWriter(str, rec, newFlusher(rec), &Connection{encoder: JSONEncoder})
+	ew.write(e)
+	ew.flush()
+	return rec.Body.String()
+}
+
+func TestEventWriterFraming(t *testing.T) {
+	s := &Stream{}
+
+	e := &Event{ID: 3, Event: "update", Data: []byte("line 1\nline 2")}
+
+	assert.Equal(t, "id: 3\nevent: update\ndata: line 1\ndata: line 2\n\n", writeTestEvent(s, e))
+}
+
+func TestEventWriterTimestamp(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := &Event{ID: 1, Data: []byte("ping"), Timestamp: ts}
+
+	s := &Stream{TimestampField: DefaultTimestampField}
+	assert.Equal(t, "id: 1\ndata: ping\n\n", writeTestEvent(s, e))
+
+	s.EmitTimestamp = true
+	assert.Equal(t, "id: 1\ntimestamp: 1577934245000\ndata: ping\n\n", writeTestEvent(s, e))
+
+	s.TimestampField = "ts"
+	s.TimestampFormat = time.RFC3339
+	assert.Equal(t, "id: 1\nts: 2020-01-02T03:04:05Z\ndata: ping\n\n", writeTestEvent(s, e))
+}
+
+func TestEventWriterLineEndings(t *testing.T) {
+	s := &Stream{Framing: Framing{LineEnding: "\r\n"}}
+
+	e := &Event{ID: 3, Data: []byte("line 1\nline 2")}
+
+	assert.Equal(t, "id: 3\r\ndata: line 1\r\ndata: line 2\r\n\r\n", writeTestEvent(s, e))
+
+	s.Framing.EventEnding = "\r\n\r\n"
+
+	assert.Equal(t, "id: 3\r\ndata: line 1\r\ndata: line 2\r\n\r\n\r\n", writeTestEvent(s, e))
+
+	s.Framing.NoEventEnding = true
+
+	assert.Equal(t, "id: 3\r\ndata: line 1\r\ndata: line 2\r\n", writeTestEvent(s, e))
+}
+
+func TestEventWriterFields(t *testing.T) {
+	s := &Stream{EmitTimestamp: true, TimestampField: DefaultTimestampField}
+
+	e := &Event{
+		ID:        2,
+		Event:     "update",
+		Data:      []byte("ping"),
+		Timestamp: time.Unix(1, 0),
+		Fields: map[string]string{
+			"trace":     "abc",
+			"region":    "eu",
+			"id":        "99",
+			"timestamp": "0",
+			"bad":       "a\nb",
+		},
+	}
+
+	assert.Equal(t, "id: 2\nevent: update\ntimestamp: 1000\nregion: eu\ntrace: abc\ndata: ping\n\n", writeTestEvent(s, e))
+}
+
+func TestEventWriterEncodeError(t *testing.T) {
+	failing := EncoderFunc(func(e *Event) ([]byte, error) {
+		if string(e.Data) == "bad" {
+			return nil, errors.New("cannot encode")
+		}
+		return e.Data, nil
+	})
+
+	var action EncodeErrorAction
+	var failed *Connection
+
+	s := &Stream{}
+	s.OnEncodeError = func(err error, e *Event, c *Connection) EncodeErrorAction {
+		assert.EqualError(t, err, "cannot encode")
+		assert.Equal(t, "bad", string(e.Data))
+		failed = c
+		return action
+	}
+
+	newWriter := func(enc Encoder) (*eventWriter, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return newEventWriter(s, rec, newFlusher(rec), &Connection{encoder: enc}), rec
+	}
+
+	for _, action = range []EncodeErrorAction{EncodeErrorSkip, EncodeErrorDrop, EncodeErrorDisconnect} {
+		e := &Event{ID: 1, Data: []byte("bad")}
+
+		fw, frec := newWriter(failing)
+		jw, jrec := newWriter(JSONEncoder)
+
+		err := fw.write(e)
+		jw.write(e)
+		fw.flush()
+		jw.flush()
+
+		assert.Equal(t, fw.conn, failed)
+		assert.Equal(t, action == EncodeErrorDisconnect, err != nil)
+		assert.Equal(t, "", frec.Body.String())
+
+		if action == EncodeErrorDrop {
+			assert.Equal(t, "", jrec.Body.String())
+		} else {
+			assert.Equal(t, "id: 1\ndata: bad\n\n", jrec.Body.String())
+		}
+	}
+}
+
+func TestEventWriterQueueWait(t *testing.T) {
+	var waits []time.Duration
+
+	s := &Stream{MeasureLatency: true}
+	s.OnQueueWait = func(c *Connection, e *Event, wait time.Duration) {
+		waits = append(waits, wait)
+	}
+
+	now := time.Now()
+	c := &Connection{encoder: JSONEncoder, timing: ConnectionTiming{RegisteredAt: now.Add(-time.Minute)}}
+
+	rec := httptest.NewRecorder()
+	ew := newEventWriter(s, rec, newFlusher(rec), c)
+
+	ew.write(&Event{ID: 1, Data: []byte("replayed"), received: now.Add(-time.Hour)})
+	ew.write(&Event{ID: 2, Data: []byte("live"), received: now.Add(-time.Millisecond * 10)})
+	ew.flush()
+
+	assert.Len(t, waits, 1)
+	assert.True(t, waits[0] >= time.Millisecond*10)
+	assert.Equal(t, "id: 1\ndata: replayed\n\nid: 2\nqueue-wait: "+waits[0].String()+"\ndata: live\n\n", rec.Body.String())
+}
+
+func TestEventSize(t *testing.T) {
+	s := &Stream{}
+
+	events := []*Event{
+		{},
+		{Data: []byte("ping")},
+		{ID: 12, Event: "update", Data: []byte("line 1\nline 2\r\nline 3\n")},
+		{ID: 1, Data: []byte("ping"), Fields: map[string]string{"trace": "abc", "data": "skipped", "bad\nname": "x"}},
+	}
+
+	for _, e := range events {
+		assert.Equal(t, len(writeTestEvent(s, e)), e.Size())
+	}
+}
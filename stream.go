@@ -5,23 +5,411 @@
 package broadcast
 
 import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// UpToDateEvent is the event type sent in place of a replay to connections
+// whose fingerprint matches the streams eventlog
+const UpToDateEvent = "_uptodate"
+
+// DefaultCatchUpEvent is the event type used for catch up complete events
+const DefaultCatchUpEvent = "_catchup_done"
+
+// DefaultTimestampField is the sse field that event timestamps are written
+// to when a stream has EmitTimestamp enabled
+const DefaultTimestampField = "timestamp"
+
+// DefaultReauthorizeInterval is how often connections are checked by
+// Stream.Reauthorize when no interval is set
+const DefaultReauthorizeInterval = time.Minute
+
+// QueueWaitField is the sse field measured queue waits are written to, see
+// Stream.MeasureLatency
+const QueueWaitField = "queue-wait"
+
+// Priority selects the lane an event is queued on before it is handled by
+// a stream. Events in a higher priority lane are handled before any that
+// are queued in a lower one.
+type Priority int
+
+const (
+	// PriorityNormal is the lane events are published on by default
+	PriorityNormal Priority = iota
+	// PriorityHigh events skip ahead of any backlog of normal events
+	PriorityHigh
+)
+
+// Framing controls the line endings used when writing server-sent events.
+// The spec allows either LF or CRLF, some intermediaries only handle one.
+type Framing struct {
+	// Ends each field line. Defaults to "\n".
+	LineEnding string
+	// Written after the last field of each event, to terminate it.
+	// Defaults to LineEnding, which produces the usual blank line.
+	EventEnding string
+	// Writes nothing after the last field of each event, ignoring
+	// EventEnding, for clients that frame events some other way
+	NoEventEnding bool
+}
+
 // Stream ...
 type Stream struct {
 	// Enables replaying of eventlog to newly added subscribers
-	AutoReplay    bool
-	log           EventLog
-	MaxInactivity time.Duration
-	stats         chan chan int
-	subscribers   []*Subscriber
-	register      chan *Subscriber
-	deregister    chan *Subscriber
-	replay        chan *Connection
-	event         chan *Event
-	quit          chan bool
-	closed        bool
+	AutoReplay bool
+	// Called by StreamHandler with the Last-Event-ID a client reconnects
+	// with, before any events are replayed. The returned id is used in its
+	// place, and an empty id replays the entire eventlog. Returning an error
+	// rejects the request. By default the clients id is used as is.
+	ValidateLastEventID func(id string) (string, error)
+	// Writes event ids to clients in the form <streamID>-<seq>, and
+	// validates the Last-Event-IDs they reconnect with when there is no
+	// ValidateLastEventID. Ids are written as plain sequences when nil.
+	EventIDs *IDGenerator
+	// Sent to each connection after its replay has completed, before any
+	// live events, so clients can tell history apart from new events. It is
+	// never added to the eventlog. Disabled when nil, which is the default
+	// so existing consumers of connection channels see no extra events;
+	// &Event{Event: DefaultCatchUpEvent} is a suitable value to enable it,
+	// on every stream through Server.DefaultStreamConfig.
+	CatchUpCompleteEvent *Event
+	// Sends each connection a CloseEvent before the server closes it, with
+	// json data giving the DisconnectReason, such as
+	// {"reason":"server_shutdown"}. Connections closed because their
+	// subscriber deregistered are not sent one. Disabled by default.
+	EmitCloseEvents bool
+	// Returns a human readable name for the subscriber StreamHandler
+	// creates for a request, such as the authenticated username. Names are
+	// only used for observability, never to identify subscribers.
+	SubscriberName func(r *http.Request) string
+	// Called when a subscriber connects, with the number of events that
+	// were replayed to the new connection
+	OnSubscribe func(sub *Subscriber, replayed int)
+	// Checks that each StreamHandler connection is still authorized, every
+	// ReauthorizeInterval, or DefaultReauthorizeInterval if unset. When it
+	// returns an error the connection is closed with ReasonAuthRevoked.
+	// It is called from the goroutine serving the connection.
+	Reauthorize         func(c *Connection) error
+	ReauthorizeInterval time.Duration
+	// Called with the timing of each new connection once it has been sent
+	// its first live event, see Connection.Timing. It is called from the
+	// goroutine delivering the event, so must not block. Requires
+	// AutoReplay.
+	OnConnectionTiming func(c *Connection, t ConnectionTiming)
+	// Called from the run loop with a copy of every event published to the
+	// stream, once it has been logged and before it is delivered, whether
+	// or not it is shed, filtered or delivered to anyone. Events that are
+	// shed or not logged have no id. It blocks the stream while it runs,
+	// so must be fast, or hand the event to another goroutine.
+	Tap func(e *Event)
+	// calls the servers Tap
+	serverTap func(e *Event)
+	// Called from the run loop after each event has been broadcast, or with
+	// FanoutSharded from the last worker to deliver it, with
+	// the number of subscribers it was delivered to and the number that
+	// could not accept it, because they had no open connections or had
+	// already received all the events they will accept. Subscribers that
+	// skip the event, by their filter or versions, are counted in neither.
+	OnBroadcastComplete func(e *Event, delivered, failed int)
+	// Called with any errors that occur while the stream is running
+	OnError func(err error)
+	// Optional collector of stream metrics
+	Metrics Metrics
+	// How often the streams backlog is reported to a Metrics that
+	// implements BacklogMetrics, starting with the first event. Defaults to
+	// DefaultBacklogInterval.
+	BacklogInterval time.Duration
+	backlogTicker   *time.Ticker
+	// Encoders available to connections, keyed by the media type clients
+	// request them with in their Accept header. Connections that do not
+	// request any of them use the JSONEncoder.
+	Encoders map[string]Encoder
+	// Called when a connections encoder fails to serialize an event, with
+	// the connection that failed. The returned action decides whether the
+	// event is skipped for that connection, dropped for every connection,
+	// or the connection is closed. Events are skipped when this is nil.
+	OnEncodeError func(err error, e *Event, c *Connection) EncodeErrorAction
+	// Adds each events timestamp to its sse output, as an extra field the
+	// browsers EventSource ignores
+	EmitTimestamp bool
+	// Name of the field timestamps are written to
+	TimestampField string
+	// Layout timestamps are formatted with, as used by time.Format. If empty,
+	// timestamps are written as milliseconds since the unix epoch.
+	TimestampFormat string
+	// Extra headers StreamHandler adds to each response, such as CORS
+	// headers. These are applied after the default headers, so can
+	// override them.
+	ResponseHeaders http.Header
+	// Line endings used in sse output
+	Framing Framing
+	// Sends each StreamHandler client a ReconnectTokenEvent, holding a token
+	// that is valid for this long. A client that reconnects with the token
+	// replaces its previous subscriber, if that is still registered, and
+	// resumes from the last event it was sent unless it also sends a
+	// Last-Event-ID. Disabled when zero.
+	ReconnectTokenTTL time.Duration
+	// Signs reconnection tokens with hmac-sha256, so only tokens issued by
+	// the stream are accepted. When unset, a random secret is generated for
+	// the stream, so tokens are only accepted by the process that issued
+	// them.
+	ReconnectSecret []byte
+	tokenSecret     []byte
+	tokenSecretOnce sync.Once
+	// Measures how long each live event waits between the stream handling
+	// it and a connections writer starting to send it. The wait is written
+	// to the sse output in the QueueWaitField, and passed to OnQueueWait.
+	// Events replayed from the eventlog are not measured.
+	MeasureLatency bool
+	// Called by connection writers with each measured wait
+	OnQueueWait func(c *Connection, e *Event, wait time.Duration)
+	// Compresses StreamHandler responses with gzip for clients that accept
+	// it. The replayed eventlog is written as a single compressed block,
+	// after which live events are still flushed one at a time. As the whole
+	// response shares one Content-Encoding, live events stay inside the
+	// gzip stream, each costing only a few bytes of framing.
+	CompressReplay bool
+	// Lets connection writers add events that are already queued to the
+	// flush of the event before them, until this many bytes are buffered.
+	// Small reconnects then have their replay and first live events sent
+	// in a single flush. Zero flushes after every event.
+	CoalesceBytes int
+	// How many queued events the run loop handles at a time before it
+	// checks for subscribers, replays and other requests again. Larger
+	// batches raise throughput for bursty streams, at the cost of how long
+	// those requests can wait. One event at a time is handled when zero.
+	DrainBatch int
+	// Sent to each client when it connects as the sse retry field, telling
+	// it how long to wait before reconnecting. Clients keep their own
+	// default when zero.
+	RetryInterval time.Duration
+	// Written to each client verbatim as soon as it connects, before the
+	// retry field and any events. It must be valid server-sent events,
+	// such as the padding comment from PaddingPreamble, which gets the
+	// stream past proxies that buffer the start of a response. Nothing is
+	// sent when empty.
+	Preamble []byte
+	// How long a connection can go without an event before its writer
+	// sends a comment to the client, so proxies do not close connections
+	// that are idle. Connections that receive events at least this often
+	// are not sent any. Disabled when zero.
+	KeepAlive time.Duration
+	// How often connection writers flush events to clients. Events are
+	// flushed as soon as they are written if this is zero.
+	FlushInterval time.Duration
+	// Limits how many events a second can be published, in bursts of up
+	// to PublishBurst events, or one if unset. Events published faster are
+	// delayed or dropped depending on PublishRateMode. This applies to
+	// every publish method, but not to events sent on Producer. Disabled
+	// when zero.
+	PublishRateLimit float64
+	PublishBurst     int
+	PublishRateMode  RateLimitMode
+	limiter          limiter
+	// number of events delayed or dropped by PublishRateLimit
+	throttled uint64
+	// Decides what happens to live events that arrive while a subscribers
+	// connection is full, unless the subscriber has its own. When nil,
+	// delivery blocks, or queues events if the subscriber has a
+	// SlowTimeout.
+	Backpressure BackpressureStrategy
+	// where subscribers acks are saved, from the servers Offsets
+	offsets OffsetStore
+	// Rejects events whose Size is larger than this many bytes, before
+	// they are queued or logged. Zero means unlimited.
+	MaxEventSize int
+	// Thresholds for Health. The run loop must answer a health check within
+	// HealthTimeout, and the event buffer must not stay full for longer
+	// than MaxSaturation. DefaultHealthTimeout and DefaultMaxSaturation are
+	// used when unset.
+	HealthTimeout time.Duration
+	MaxSaturation time.Duration
+	// when the event buffer was last seen to become full, in unix nanoseconds
+	saturatedSince int64
+	// Sheds load while the event buffer stays saturated. Disabled when nil.
+	OverloadPolicy *OverloadPolicy
+	breaker        breaker
+	// Returns the natural key of an event, such as its type and the id of
+	// the entity it describes. When set, logging an event removes any
+	// earlier events with the same key, so the eventlog only holds the
+	// latest event for each key. Event ids are still assigned by the
+	// eventlog, and when nil every event is kept, as each has its own id.
+	KeyFunc func(e *Event) string
+	// Keeps the eventlog gzipped in memory, decompressing events as they
+	// are replayed or read from History. This trades CPU on every replay
+	// for a smaller eventlog, so suits streams with large events that
+	// clients rarely reconnect to. Byte limits count the compressed size.
+	CompressLog bool
+	// Limits the number of events held in the eventlog, dropping the
+	// oldest beyond it. Zero means unlimited.
+	MaxLogSize int
+	// Chooses further events to drop from the eventlog each time one is
+	// logged, such as LogMaxAge or LogMaxBytes. The newest event is always
+	// kept, so event ids continue from it.
+	LogPolicy EventLogPolicy
+	// Reconstructs state from delta events for replay. Events published
+	// with Delta set are delivered live and logged as they are, but are
+	// replayed by applying each to the event before it with the same key,
+	// so new connections are sent the resulting state as a single event
+	// with the id of the last delta applied. It must return a new event
+	// rather than modify base. Deltas it returns an error for are replayed
+	// as they are. When KeyFunc is also set, an event that is not a delta
+	// replaces the earlier events with its key.
+	ApplyDelta func(base, delta *Event) (*Event, error)
+	// Builds a single event representing the current state from the
+	// eventlog, after any KeyFunc compaction and ApplyDelta reconstruction.
+	// When set, new connections are sent this event in place of a replay,
+	// then live events as usual. The snapshot is given the id of the
+	// newest logged event, so clients that reconnect are sent a new one.
+	// It is called from the run loop. Nothing is sent if it returns nil.
+	Snapshot func(events []*Event) *Event
+	// Converts events to the previous version of their schema, keyed by
+	// the version they convert from, for subscribers with a MaxVersion
+	// older than an events Version. Conversions are chained, so a version
+	// 3 event reaches a version 1 subscriber through the transforms for 3
+	// and 2. Events are skipped for subscribers when a transform needed is
+	// missing or returns nil. StreamHandler takes the MaxVersion from a
+	// version parameter in the Accept header, such as
+	// application/json; version=1.
+	Downgrades map[int]VersionTransform
+	// Orders the streams closed by Server.Close, highest first
+	ShutdownPriority int
+	// Sends each connection a ReplayModeEvent before it is replayed to,
+	// saying whether the replay continues from the clients last event or
+	// is the entire eventlog. Clients that may have missed events, see
+	// ReplayFull, are then replayed the entire eventlog rather than the
+	// events after their last event id.
+	EmitReplayMode bool
+	// loads the initial eventlog, see StreamConfig.Seed
+	seed func() ([]*Event, error)
+	// id of the newest event evicted from the eventlog to free space, or -1
+	evictedID int
+	// Order the eventlog is replayed to new connections in. Defaults to
+	// Ascending, oldest first.
+	ReplayOrder ReplayOrder
+	// Replays the eventlog to new connections in chunks of this many
+	// events, from a separate goroutine rather than the run loop. Each
+	// chunk is only sent once the connections writer has taken the last
+	// one, so replay never queues faster than the client reads, and
+	// OnSubscribe is called from that goroutine. Zero replays the whole
+	// eventlog at once.
+	ReplayChunkSize int
+	// Optional pause between replay chunks
+	ReplayChunkDelay time.Duration
+	// Limits how many chunked replays run at once. Connections beyond it
+	// wait for a running replay to finish before theirs starts, holding
+	// live events as they would during replay. Zero means unlimited.
+	MaxConcurrentReplays int
+	replaySlots          chan struct{}
+	// number of connections waiting for a replay slot, and the number of
+	// chunked replays running
+	queuedReplays int64
+	activeReplays int64
+	// Rotates the subscriber each event is delivered to first, so that
+	// slow or partial deliveries are not always at the expense of the same
+	// subscribers. Subscribers are served in the order they registered
+	// when false.
+	RotateDelivery bool
+	rotation       int
+	// Delivers each event to subscribers with a higher SubscriberOptions.Tier
+	// before those with a lower one, so they are served first when delivery
+	// is slow. Subscribers of the same tier are served in the order they
+	// registered, or rotated with RotateDelivery. With fanout workers, the
+	// highest tiers are handed to workers first.
+	TieredDelivery bool
+	// the subscribers ordered by tier, and the index each tier starts at,
+	// or nil when the subscribers have changed
+	tiered []*Subscriber
+	tiers  []int
+	// Builds a summary of the events handled in each SummaryInterval, such
+	// as counts by type, which is delivered to every subscriber but not
+	// logged. Summaries are given the DefaultSummaryEvent type unless they
+	// set one, so subscribers can filter for them with
+	// SubscriberOptions.Filter. Targeted events are not included, and
+	// nothing is sent if it returns nil. The first summary is due one
+	// interval after the first event, and it is called from the run loop.
+	Summarize       func(recent []*Event) *Event
+	SummaryInterval time.Duration
+	summaryTicker   *time.Ticker
+	recent          []*Event
+	// Number of workers used to deliver each event to subscribers.
+	// Values of 0 or 1 deliver to every subscriber from the run loop.
+	// FanoutMode chooses how subscribers are shared between the workers.
+	FanoutWorkers int
+	FanoutMode    FanoutMode
+	// queues of the workers for FanoutSharded, and the subscribers of each
+	// shard, or nil when the subscribers have changed
+	shardQueues []chan shardJob
+	shards      [][]*Subscriber
+	shardWG     sync.WaitGroup
+	log         EventLog
+	logHash     uint64
+	logBytes    int
+	// called with the change in logBytes whenever it changes
+	onLogResize func(delta int)
+	// the ids of the logged events with each KeyFunc key, and the key of
+	// each id, so compaction needn't call KeyFunc on the whole eventlog
+	keyedIDs map[string][]int
+	logKeys  map[int]string
+	// copy of the eventlog kept outside of the process
+	backend LogBackend
+	// called from the run loop once the stream has closed
+	onClose func()
+	// reserve and release places for subscribers in a servers total
+	reserveSubscriber func() bool
+	releaseSubscriber func(n int)
+	// number of events ever published to the stream
+	totalPublished uint64
+	MaxInactivity  time.Duration
+	// Called from the run loop when the stream is closed after
+	// MaxInactivity, before its subscribers are removed and it is closed.
+	// Subscribers still registered are then sent a close event with
+	// ReasonInactive if EmitCloseEvents is set.
+	OnReap func()
+	// when the inactivity timer was last reset
+	activeAt time.Time
+	// Counts registered subscribers as activity even while they have no
+	// connections, so the stream is not closed after MaxInactivity while
+	// they are between connections
+	KeepAliveWithSubscribers bool
+	subscribers              []*Subscriber
+	// position of each subscriber in subscribers, by id
+	subscriberIndex map[string]int
+	register        chan *Subscriber
+	deregister      chan *Subscriber
+	evict           chan *Subscriber
+	replay          chan *Connection
+	event           chan *Event
+	urgent          chan *Event
+	fanout          chan fanoutJob
+	fanoutWG        sync.WaitGroup
+	// see Producer
+	producer     chan *Event
+	producerOnce sync.Once
+	// subscribers the fanout workers have delivered the current event to,
+	// and that skipped it
+	fanoutDelivered int64
+	fanoutSkipped   int64
+	matched         []*Subscriber
+	ctrl            chan controlRequest
+	reconfigure     chan reconfigureReq
+	quit            chan bool
+	done            chan struct{}
+	closed          bool
+	draining        int32
+	// held while sending on the streams channels, so cleanup only closes
+	// them once nothing is sending
+	sendMu      sync.RWMutex
+	chansClosed bool
+	// guards the settings Reconfigure changes while connections run, and
+	// is closed and replaced whenever they change
+	configMu      sync.RWMutex
+	configChanged chan struct{}
 }
 
 // StreamRegistration ...
@@ -32,57 +420,169 @@ type StreamRegistration struct {
 
 // newStream returns a new stream
 func newStream(bufsize int) *Stream {
+	s := newConfiguredStream(bufsize, StreamConfig{})
+	s.run()
+	return s
+}
+
+// newConfiguredStream returns a new stream with cfg applied, that has not
+// been started with run
+func newConfiguredStream(bufsize int, cfg StreamConfig) *Stream {
 	s := &Stream{
-		AutoReplay:    true,
-		MaxInactivity: DefaultMaxInactivity,
-		log:           make(EventLog, 0),
-		subscribers:   make([]*Subscriber, 0),
-		register:      make(chan *Subscriber),
-		deregister:    make(chan *Subscriber),
-		replay:        make(chan *Connection),
-		event:         make(chan *Event, bufsize),
-		quit:          make(chan bool),
+		AutoReplay:      true,
+		TimestampField:  DefaultTimestampField,
+		Encoders:        map[string]Encoder{"application/json": JSONEncoder},
+		MaxInactivity:   DefaultMaxInactivity,
+		log:             make(EventLog, 0),
+		evictedID:       -1,
+		subscribers:     make([]*Subscriber, 0),
+		subscriberIndex: make(map[string]int),
+		register:        make(chan *Subscriber),
+		deregister:      make(chan *Subscriber),
+		evict:           make(chan *Subscriber),
+		replay:          make(chan *Connection),
+		event:           make(chan *Event, bufsize),
+		urgent:          make(chan *Event, bufsize),
+		ctrl:            make(chan controlRequest),
+		reconfigure:     make(chan reconfigureReq),
+		configChanged:   make(chan struct{}),
+		quit:            make(chan bool),
+		done:            make(chan struct{}),
 	}
 
-	s.run()
+	s.apply(cfg)
 
 	return s
 }
 
 func (str *Stream) run() {
 	go func(str *Stream) {
+		// reused between iterations, rather than allocating a new timer for
+		// every event with time.After
+		inactivity := time.NewTimer(str.MaxInactivity)
+		defer inactivity.Stop()
+
+		if str.backend != nil {
+			str.loadBackend()
+		}
+		if str.seed != nil {
+			str.seedLog()
+		}
+		str.activeAt = time.Now()
+
 		for {
 			select {
 			// Add new subscriber
 			case subscriber := <-str.register:
 				if str.AutoReplay {
+					subscriber.mu.Lock()
 					subscriber.replay = str.replay
+					subscriber.mu.Unlock()
+				}
+				subscriber.mu.Lock()
+				subscriber.joined = time.Now()
+				subscriber.mu.Unlock()
+				if !str.appendSubscriber(subscriber) {
+					// already registered, so was counted already
+					str.releaseSubscribers(1)
+					break
 				}
-				str.subscribers = append(str.subscribers, subscriber)
+				if subscriber.options.Exclusive {
+					str.supersede(subscriber)
+				}
+				subscriber.watch(str.evict, str.done)
 
 			// Remove closed subscriber
 			case subscriber := <-str.deregister:
 				i := str.getSubscriberIndex(subscriber)
 				if i != -1 {
-					str.removeSubscriber(i)
+					str.removeSubscriber(i, ReasonNone)
+				}
+
+			// Remove subscribers that have stopped keeping up
+			case subscriber := <-str.evict:
+				i := str.getSubscriberIndex(subscriber)
+				if i != -1 {
+					str.removeSubscriber(i, ReasonSlowConsumer)
+					str.reportError(&SubscriberError{SubscriberID: subscriber.id, SubscriberName: subscriber.Name(), Err: ErrSlowConsumer})
+					if str.Metrics != nil {
+						str.Metrics.SubscriberEvicted(subscriber)
+					}
 				}
 
 			// Publish event to subscribers
+			// High priority events are handled before any queued behind
+			// them in the normal lane
+			case event := <-str.urgent:
+				str.handleEvent(event)
+
 			case event := <-str.event:
-				if str.AutoReplay {
-					str.log.Add(event)
-				}
-				for i := range str.subscribers {
-					str.subscribers[i].Broadcast(event)
-				}
+				str.drainUrgent()
+				str.handleEvent(event)
+				str.drainBatch()
 
 			// Replay events to new connections
 			case conn := <-str.replay:
-				str.log.Replay(conn)
+				// events logged before the replay must reach the
+				// connection before it, or not at all
+				str.settleShards()
+				replayed, last := 0, -1
+				fp := str.fingerprint()
+				if str.EmitReplayMode && conn.fingerprint != fp && !str.replaySuspended() {
+					str.resume(conn)
+				}
+				if conn.fingerprint == fp {
+					conn.deliver(&Event{Event: UpToDateEvent, Data: []byte(fp)})
+				} else if !str.replaySuspended() && str.Snapshot != nil {
+					replayed, last = str.snapshot(conn)
+				} else if !str.replaySuspended() && str.ReplayChunkSize > 0 {
+					evid, _ := strconv.Atoi(conn.eventid)
+					log := str.replayLog(evid - 1)
+					events := log.After(evid - 1)
+					if str.ReplayOrder == Descending {
+						events = events.reverse()
+					}
+					if str.MaxConcurrentReplays > 0 && str.replaySlots == nil {
+						str.replaySlots = make(chan struct{}, str.MaxConcurrentReplays)
+					}
+					go str.replayChunked(conn, events, str.replaySlots)
+					break
+				} else if !str.replaySuspended() {
+					evid, _ := strconv.Atoi(conn.eventid)
+					log := str.replayLog(evid - 1)
+					replayed, last = log.replay(conn, str.ReplayOrder)
+				}
+				str.finishReplay(conn, replayed, last)
+
+			// Answer queries and commands that need the streams state
+			case req := <-str.ctrl:
+				req.handle(str)
+				continue
+
+			// Apply new settings, keeping the time already spent inactive
+			case req := <-str.reconfigure:
+				str.reconfigureLive(req.cfg)
+				resetTimer(inactivity, str.MaxInactivity-time.Since(str.activeAt))
+				close(req.done)
+				continue
+
+			// Summaries are not activity, as they are only sent while
+			// events are being published
+			case <-str.summaries():
+				str.summarize()
+				continue
+
+			case <-str.backlogReports():
+				str.reportBacklog()
+				continue
 
 			// Kill stream if there are no users and no activity on the stream
-			case <-time.After(str.MaxInactivity):
+			case <-inactivity.C:
 				if !str.hasActiveSubscribers() {
+					if str.OnReap != nil {
+						str.OnReap()
+					}
+					str.removeAllSubscribers(ReasonInactive)
 					str.cleanup()
 					return
 				}
@@ -90,32 +590,616 @@ func (str *Stream) run() {
 			// Shutdown if the server closes
 			case <-str.quit:
 				// remove connections
-				str.removeAllSubscribers()
+				str.removeAllSubscribers(ReasonShutdown)
 				str.cleanup()
 				return
 			}
+
+			str.activeAt = time.Now()
+			resetTimer(inactivity, str.MaxInactivity)
 		}
 	}(str)
 }
 
+// finishReplay completes the replay of the eventlog to a connection,
+// delivering any live events that were held during it
+func (str *Stream) finishReplay(conn *Connection, replayed, last int) {
+	if str.CatchUpCompleteEvent != nil {
+		// each connection is sent its own copy, so dropping it for one
+		// does not drop it for the rest
+		e := str.CatchUpCompleteEvent.copy()
+		e.catchUp = true
+		conn.deliver(e)
+	}
+	conn.mu.Lock()
+	conn.onFirstLive = str.OnConnectionTiming
+	conn.mu.Unlock()
+	conn.endReplay(last)
+	if str.OnSubscribe != nil {
+		str.OnSubscribe(conn.subscriber, replayed)
+	}
+}
+
+// handleEvent logs an event and delivers it to subscribers
+func (str *Stream) handleEvent(event *Event) {
+	if event.batch != nil {
+		str.handleBatch(event.batch)
+		return
+	}
+
+	str.count()
+	str.updateBreaker()
+	if str.shed(event) {
+		str.stamp(event)
+		str.tap(event)
+		event.complete(ErrEventShed)
+		return
+	}
+	str.dispatch(event)
+}
+
+// handleBatch handles the events of a batch one after another, so nothing
+// else is handled between them. The batch is shed as a whole if any of its
+// events would be.
+func (str *Stream) handleBatch(batch []*Event) {
+	for range batch {
+		str.count()
+	}
+
+	str.updateBreaker()
+	for i := range batch {
+		if str.shed(batch[i]) {
+			for j := range batch {
+				str.stamp(batch[j])
+				str.tap(batch[j])
+			}
+			return
+		}
+	}
+
+	for i := range batch {
+		str.dispatch(batch[i])
+	}
+}
+
+// count counts an event that has reached the stream
+func (str *Stream) count() {
+	str.totalPublished++
+	str.recordSaturation()
+}
+
+// tap passes a copy of an event to the taps, so they can keep it while the
+// stream goes on to change the event
+func (str *Stream) tap(event *Event) {
+	if str.Tap == nil && str.serverTap == nil {
+		return
+	}
+
+	e := event.copy()
+	if str.Tap != nil {
+		str.Tap(e)
+	}
+	if str.serverTap != nil {
+		str.serverTap(e)
+	}
+}
+
+// stamp records when the stream handled an event
+func (str *Stream) stamp(event *Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if str.MeasureLatency {
+		event.received = time.Now()
+	}
+}
+
+// dispatch logs an event that has not been shed and delivers it
+func (str *Stream) dispatch(event *Event) {
+	str.stamp(event)
+	if str.AutoReplay && event.match == nil {
+		str.logEvent(event)
+	}
+	str.tap(event)
+	str.broadcast(event)
+	str.recordSummary(event)
+	str.startBacklogReports()
+	event.complete(nil)
+}
+
+// drainBatch handles up to DrainBatch more events already queued in the
+// normal lane, without waiting for any to arrive
+func (str *Stream) drainBatch() {
+	for i := 1; i < str.DrainBatch; i++ {
+		select {
+		case event := <-str.event:
+			str.drainUrgent()
+			str.handleEvent(event)
+		default:
+			return
+		}
+	}
+}
+
+// drainUrgent handles every event queued in the high priority lane
+func (str *Stream) drainUrgent() {
+	for {
+		select {
+		case event := <-str.urgent:
+			str.handleEvent(event)
+		default:
+			return
+		}
+	}
+}
+
+// nextID returns the id of the next event logged, continuing after any
+// events that were evicted or replaced by SetLog
+func (str *Stream) nextID() int {
+	if id := str.log.nextid(); id > str.evictedID {
+		return id
+	}
+	return str.evictedID + 1
+}
+
+// logEvent adds an event to the eventlog
+func (str *Stream) logEvent(e *Event) {
+	e.ID = str.nextID()
+	e.logged = true
+	str.log = append(str.log, e)
+
+	str.logHash ^= e.hash()
+	str.persist(e)
+
+	if str.KeyFunc != nil {
+		key := str.KeyFunc(e)
+		// deltas build on the events before them, so are never compacted
+		if !e.Delta {
+			str.compact(str.keyedIDs[key])
+			delete(str.keyedIDs, key)
+		}
+		str.indexKey(e.ID, key)
+	}
+
+	size := len(e.Data)
+	if str.CompressLog {
+		stored := e.compressed()
+		str.log[len(str.log)-1] = stored
+		size = len(stored.Data)
+	}
+
+	str.logBytes += size
+
+	if str.onLogResize != nil {
+		str.onLogResize(size)
+	}
+
+	str.applyLogPolicy()
+}
+
+// indexKey records the key of a logged event for compaction
+func (str *Stream) indexKey(id int, key string) {
+	if str.keyedIDs == nil {
+		str.keyedIDs = make(map[string][]int)
+		str.logKeys = make(map[int]string)
+	}
+	str.keyedIDs[key] = append(str.keyedIDs[key], id)
+	str.logKeys[id] = key
+}
+
+// compact removes the events with the given ids, those with the same key
+// as the event just logged, from the eventlog
+func (str *Stream) compact(ids []int) {
+	var freed int
+	var removed []int
+
+	for _, id := range ids {
+		i := sort.Search(len(str.log), func(i int) bool { return str.log[i].ID >= id })
+		if i == len(str.log) || str.log[i].ID != id {
+			continue
+		}
+
+		ev := str.log[i]
+		str.logHash ^= ev.hash()
+		freed += len(ev.Data)
+		removed = append(removed, id)
+		delete(str.logKeys, id)
+
+		copy(str.log[i:], str.log[i+1:])
+		str.log[len(str.log)-1] = nil
+		str.log = str.log[:len(str.log)-1]
+	}
+
+	str.truncateBackend(removed)
+
+	if freed > 0 {
+		str.logBytes -= freed
+		if str.onLogResize != nil {
+			str.onLogResize(-freed)
+		}
+	}
+}
+
+// unindexKey forgets the key of an event dropped from the eventlog. Events
+// are dropped oldest first, so it is the first id with its key.
+func (str *Stream) unindexKey(id int) {
+	key, ok := str.logKeys[id]
+	if !ok {
+		return
+	}
+	delete(str.logKeys, id)
+
+	ids := str.keyedIDs[key]
+	if len(ids) <= 1 {
+		delete(str.keyedIDs, key)
+		return
+	}
+	str.keyedIDs[key] = ids[1:]
+}
+
+// dropOldest removes the oldest events from the eventlog until at least
+// size bytes have been freed, always keeping the newest event so event ids
+// continue from it. It returns the number of bytes freed.
+func (str *Stream) dropOldest(size int) int {
+	var n, freed int
+	for n < len(str.log)-1 && freed < size {
+		freed += len(str.log[n].Data)
+		n++
+	}
+
+	return str.dropEvents(n)
+}
+
+// dropEvents removes the n oldest events from the eventlog, always keeping
+// the newest event. It returns the number of bytes freed.
+func (str *Stream) dropEvents(n int) int {
+	if n <= 0 || len(str.log) <= 1 {
+		return 0
+	}
+
+	var freed int
+	var dropped []int
+
+	for ; n > 0 && len(str.log) > 1; n-- {
+		e := str.log[0]
+		str.log[0] = nil
+		str.log = str.log[1:]
+
+		str.logHash ^= e.hash()
+		freed += len(e.Data)
+		str.evictedID = e.ID
+		dropped = append(dropped, e.ID)
+		str.unindexKey(e.ID)
+	}
+
+	str.truncateBackend(dropped)
+	str.logBytes -= freed
+
+	if str.onLogResize != nil && freed > 0 {
+		str.onLogResize(-freed)
+	}
+
+	return freed
+}
+
+// resetTimer restarts a timer that may or may not have fired
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
 func (str *Stream) close() {
 	if str.closed {
 		return
 	}
-	str.quit <- true
+
+	str.send(func() bool {
+		select {
+		case str.quit <- true:
+			return true
+		case <-str.done:
+			return false
+		}
+	})
 }
 
+// send runs fn, which sends on one of the streams channels, unless cleanup
+// has closed them. fn must select on done as well, and reports whether it
+// sent.
+func (str *Stream) send(fn func() bool) bool {
+	str.sendMu.RLock()
+	defer str.sendMu.RUnlock()
+
+	if str.chansClosed {
+		return false
+	}
+	return fn()
+}
+
+// cleanup marks the stream as done, then closes its channels. Closing done
+// first releases any sender still waiting on them.
 func (str *Stream) cleanup() {
+	str.stopFanoutWorkers()
+	str.stopSummaries()
+	str.stopBacklogReports()
+	str.releaseSubscribers(len(str.subscribers))
+	if str.onLogResize != nil && str.logBytes != 0 {
+		str.onLogResize(-str.logBytes)
+	}
+	close(str.done)
+	str.closed = true
+	if str.onClose != nil {
+		str.onClose()
+	}
+
+	str.sendMu.Lock()
+	str.chansClosed = true
 	close(str.event)
 	close(str.register)
 	close(str.deregister)
 	close(str.quit)
-	str.closed = true
+	str.sendMu.Unlock()
+}
+
+// publish queues an event to be sent to all subscribers
+func (str *Stream) publish(e *Event) {
+	str.publishPriority(e, PriorityNormal)
+}
+
+// Publish queues an event to be sent to all subscribers. It returns
+// ErrStreamClosed if the stream has closed, ErrEventTooLarge if the event is
+// larger than the streams MaxEventSize, or ErrRateLimited if the event was
+// dropped by the streams PublishRateLimit.
+func (str *Stream) Publish(e *Event) error {
+	return str.publishPriority(e, PriorityNormal)
 }
 
-func (str *Stream) getSubscriber(id string) *Subscriber {
+// PublishBatch queues events to be handled as a single unit. They are
+// logged and delivered to each subscriber one after another, with no other
+// event or request handled between them, and an OverloadPolicy sheds either
+// all or none of them. It returns the same errors as Publish, and counts as
+// a single publish for PublishRateLimit.
+func (str *Stream) PublishBatch(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	for i := range events {
+		if err := str.checkSize(events[i]); err != nil {
+			return err
+		}
+	}
+
+	return str.publishPriority(&Event{batch: events}, PriorityNormal)
+}
+
+// publishPriority queues an event on the lane for its priority
+func (str *Stream) publishPriority(e *Event, p Priority) error {
+	select {
+	case <-str.done:
+		return ErrStreamClosed
+	default:
+	}
+
+	if err := str.checkSize(e); err != nil {
+		return err
+	}
+
+	if err := str.throttle(); err != nil {
+		return err
+	}
+
+	lane := str.event
+	if p == PriorityHigh {
+		lane = str.urgent
+	}
+
+	if !str.send(func() bool {
+		select {
+		case lane <- e:
+			return true
+		case <-str.done:
+			return false
+		}
+	}) {
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// checkSize rejects events larger than the streams MaxEventSize
+func (str *Stream) checkSize(e *Event) error {
+	if str.MaxEventSize > 0 && e.Size() > str.MaxEventSize {
+		return ErrEventTooLarge
+	}
+	return nil
+}
+
+// Producer returns a channel that publishes each event sent on it, for
+// fanning in events from many goroutines. Events are published as Publish
+// does, so are subject to the streams MaxEventSize and PublishRateLimit,
+// and errors publishing them are passed to OnError. The channel holds up
+// to the size the stream was created with (Server.BufferSize) and sends
+// block while it is full. It is never closed, so sending on it cannot
+// panic, but events sent after the stream has closed are discarded and
+// sends block once the buffer fills. Producers that may outlive the stream
+// should select on Done as well.
+func (str *Stream) Producer() chan<- *Event {
+	str.producerOnce.Do(func() {
+		str.producer = make(chan *Event, cap(str.event))
+		go str.produce()
+	})
+	return str.producer
+}
+
+// produce publishes the events sent on the producer channel until the
+// stream closes
+func (str *Stream) produce() {
+	for {
+		select {
+		case e := <-str.producer:
+			if err := str.publishPriority(e, PriorityNormal); err != nil && err != ErrStreamClosed {
+				str.reportError(err)
+			}
+		case <-str.done:
+			return
+		}
+	}
+}
+
+// Done returns a channel that is closed once the stream has closed
+func (str *Stream) Done() <-chan struct{} {
+	return str.done
+}
+
+// PublishSync publishes an event and waits until it has been handed to
+// every subscriber registered when the stream handled it. It returns
+// ErrStreamClosed if the stream closes first, or ErrEventShed if the
+// streams OverloadPolicy dropped the event. Like Publish, it is subject to
+// the streams MaxEventSize and PublishRateLimit.
+func (str *Stream) PublishSync(e *Event) error {
+	if err := str.checkSize(e); err != nil {
+		return err
+	}
+
+	if err := str.throttle(); err != nil {
+		return err
+	}
+
+	reply := make(chan error, 1)
+	e.sync = reply
+
+	if !str.send(func() bool {
+		select {
+		case str.event <- e:
+			return true
+		case <-str.done:
+			return false
+		}
+	}) {
+		return ErrStreamClosed
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-str.done:
+		return ErrStreamClosed
+	}
+}
+
+// History returns a copy of the streams eventlog, without registering a subscriber
+func (str *Stream) History() EventLog {
+	reply := make(chan EventLog, 1)
+	if !str.control(historyReq{reply: reply}) {
+		return nil
+	}
+	return <-reply
+}
+
+// PublishWhere sends an event to every subscriber that match returns true
+// for. The matcher is called from the streams run loop, so it sees the
+// subscribers as they are when the event is delivered. Targeted events are
+// not added to the eventlog, so are never replayed. The event is copied, so
+// the caller may publish it again to every subscriber.
+func (str *Stream) PublishWhere(match func(*Subscriber) bool, e *Event) {
+	e = e.copy()
+	e.match = match
+	str.publish(e)
+}
+
+// PublishTo sends an event to every subscriber with the given key
+func (str *Stream) PublishTo(key string, e *Event) {
+	str.PublishWhere(func(sub *Subscriber) bool {
+		return sub.key == key
+	}, e)
+}
+
+// PublishToMany sends an event to every subscriber with any of the given keys
+func (str *Stream) PublishToMany(keys []string, e *Event) {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+
+	str.PublishWhere(func(sub *Subscriber) bool {
+		return set[sub.key]
+	}, e)
+}
+
+// SetDraining stops the stream from accepting new subscribers while it is
+// draining. Existing subscribers continue to receive events until they
+// disconnect or the stream is closed.
+func (str *Stream) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&str.draining, v)
+}
+
+// Draining returns true if the stream is not accepting new subscribers
+func (str *Stream) Draining() bool {
+	return atomic.LoadInt32(&str.draining) == 1
+}
+
+// drainPollInterval is how often Drain checks for remaining subscribers
+const drainPollInterval = time.Millisecond * 50
+
+// Drain sets the stream draining and waits for its subscribers to
+// disconnect. Any still connected once ctx is done are disconnected with
+// ReasonDraining, and the contexts error is returned.
+func (str *Stream) Drain(ctx context.Context) error {
+	str.SetDraining(true)
+
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+
+	for str.SubscriberCount() > 0 {
+		select {
+		case <-poll.C:
+		case <-ctx.Done():
+			str.control(dropSubscribersReq{reason: ReasonDraining})
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Flush makes every connection write out any events it is buffering. It
+// has no effect unless the stream has a FlushInterval.
+func (str *Stream) Flush() {
+	if str.settings().FlushInterval <= 0 {
+		return
+	}
+
+	str.control(flushReq{})
+}
+
+// Fingerprint returns a hash of the events currently held in the streams
+// eventlog. Clients can present it when reconnecting to skip replay if
+// they have not missed any events.
+func (str *Stream) Fingerprint() string {
+	reply := make(chan string, 1)
+	if !str.control(fingerprintReq{reply: reply}) {
+		return ""
+	}
+	return <-reply
+}
+
+func (str *Stream) fingerprint() string {
+	return strconv.FormatUint(str.logHash, 16)
+}
+
+func (str *Stream) getSubscriber(key string) *Subscriber {
 	for i := range str.subscribers {
-		if str.subscribers[i].id == id {
+		if str.subscribers[i].key == key {
 			return str.subscribers[i]
 		}
 	}
@@ -123,36 +1207,130 @@ func (str *Stream) getSubscriber(id string) *Subscriber {
 	return nil
 }
 
-func (str *Stream) getSubscriberIndex(sub *Subscriber) int {
-	for i := range str.subscribers {
-		if str.subscribers[i].id == sub.id {
-			return i
+// supersede removes every other subscriber with the same key as sub
+func (str *Stream) supersede(sub *Subscriber) {
+	if sub.key == "" {
+		return
+	}
+
+	// deleteSubscriber moves the last subscriber into the removed ones
+	// place, which has already been checked when walking backwards
+	for i := len(str.subscribers) - 1; i >= 0; i-- {
+		if other := str.subscribers[i]; other != sub && other.key == sub.key {
+			str.removeSubscriber(i, ReasonSuperseded)
 		}
 	}
-	return -1
+}
+
+func (str *Stream) getSubscriberIndex(sub *Subscriber) int {
+	i, ok := str.subscriberIndex[sub.id]
+	if !ok {
+		return -1
+	}
+	return i
+}
+
+// appendSubscriber adds a subscriber, returning false if it was already
+// registered
+func (str *Stream) appendSubscriber(sub *Subscriber) bool {
+	if _, ok := str.subscriberIndex[sub.id]; ok {
+		return false
+	}
+	str.subscriberIndex[sub.id] = len(str.subscribers)
+	str.subscribers = append(str.subscribers, sub)
+	str.subscribersChanged()
+	return true
 }
 
 // addSubscriber will register a subscriber on a stream
-func (str *Stream) addSubscriber(sub *Subscriber) {
+func (str *Stream) addSubscriber(sub *Subscriber) error {
+	if str.Draining() {
+		return ErrStreamDraining
+	}
+
 	sub.quit = str.deregister
+	sub.send = str.send
 	sub.replay = str.replay
-	str.register <- sub
+	sub.done = str.done
+	if str.reserveSubscriber != nil && !str.reserveSubscriber() {
+		return ErrTooManySubscribers
+	}
+
+	sub.closeEvents = str.EmitCloseEvents
+	sub.downgrades = str.Downgrades
+	sub.backpressure = str.Backpressure
+	sub.offsets = str.offsets
+
+	if !str.send(func() bool {
+		select {
+		case str.register <- sub:
+			return true
+		case <-str.done:
+			return false
+		}
+	}) {
+		str.releaseSubscribers(1)
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// releaseSubscribers gives back the places of subscribers that have left
+// the stream, see Server.MaxTotalSubscribers
+func (str *Stream) releaseSubscribers(n int) {
+	if str.releaseSubscriber != nil && n > 0 {
+		str.releaseSubscriber(n)
+	}
 }
 
-func (str *Stream) removeSubscriber(i int) {
-	str.subscribers[i].DisconnectAll()
-	str.subscribers = append(str.subscribers[:i], str.subscribers[i+1:]...)
+func (str *Stream) removeSubscriber(i int, reason DisconnectReason) {
+	str.subscribers[i].unwatch()
+	str.subscribers[i].DisconnectAllWithReason(reason)
+	str.deleteSubscriber(i)
 }
 
-func (str *Stream) removeAllSubscribers() {
+func (str *Stream) removeAllSubscribers(reason DisconnectReason) {
 	for i := range str.subscribers {
-		str.subscribers[i].DisconnectAll()
+		str.subscribers[i].unwatch()
+		str.subscribers[i].DisconnectAllWithReason(reason)
 	}
 
+	str.releaseSubscribers(len(str.subscribers))
 	str.subscribers = str.subscribers[:0]
+	str.subscribersChanged()
+	str.subscriberIndex = make(map[string]int)
+}
+
+// deleteSubscriber removes the subscriber at position i in constant time,
+// by moving the last subscriber into its place. This only changes the
+// delivery order of the moved subscriber.
+func (str *Stream) deleteSubscriber(i int) {
+	last := len(str.subscribers) - 1
+
+	delete(str.subscriberIndex, str.subscribers[i].id)
+
+	if i != last {
+		str.subscribers[i] = str.subscribers[last]
+		str.subscriberIndex[str.subscribers[i].id] = i
+	}
+
+	str.subscribers[last] = nil
+	str.subscribers = str.subscribers[:last]
+	str.subscribersChanged()
+	str.releaseSubscribers(1)
+}
+
+func (str *Stream) reportError(err error) {
+	if str.OnError != nil {
+		str.OnError(err)
+	}
 }
 
 func (str *Stream) hasActiveSubscribers() bool {
+	if str.KeepAliveWithSubscribers && len(str.subscribers) > 0 {
+		return true
+	}
+
 	for i := range str.subscribers {
 		if str.subscribers[i].HasConnections() {
 			return true
@@ -5,7 +5,11 @@
 package broadcast
 
 import (
+	"errors"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,7 +33,7 @@ func TestStreamDeregisterSubscriber(t *testing.T) {
 	sub := NewSubscriber("test")
 	s.addSubscriber(sub)
 
-	s.removeSubscriber(0)
+	s.removeSubscriber(0, ReasonNone)
 
 	assert.Len(t, s.subscribers, 0)
 }
@@ -181,3 +185,1555 @@ func TestStreamInactivity(t *testing.T) {
 
 	assert.True(t, s.closed)
 }
+
+func TestStreamKeepAliveWithSubscribers(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.MaxInactivity = time.Second
+	s.KeepAliveWithSubscribers = true
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+
+	time.Sleep(time.Second * 2)
+
+	assert.False(t, sub.HasConnections())
+	assert.False(t, s.closed)
+
+	sub.Close()
+
+	time.Sleep(time.Second * 2)
+
+	assert.True(t, s.closed)
+}
+
+func TestStreamSubscribersWithSameKey(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub1 := NewSubscriber("test")
+	sub2 := NewSubscriber("test")
+
+	assert.NotEqual(t, sub1.ID(), sub2.ID())
+	assert.Equal(t, "test", sub2.Key())
+
+	s.addSubscriber(sub1)
+	s.addSubscriber(sub2)
+
+	sub1.Close()
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Len(t, s.subscribers, 1)
+	assert.Equal(t, sub2.ID(), s.subscribers[0].ID())
+}
+
+func TestStreamReplayWithFingerprint(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 10; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	fp := s.Fingerprint()
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+
+	c := sub.ConnectWithFingerprint(fp)
+	e := <-c
+	assert.Equal(t, UpToDateEvent, e.Event)
+	assert.Equal(t, fp, string(e.Data))
+
+	c = sub.ConnectWithFingerprint("stale")
+	for i := 0; i < 10; i++ {
+		e := <-c
+		assert.Equal(t, string(e.Data), strconv.Itoa(i))
+	}
+}
+
+func TestStreamEvictSlowSubscriber(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	errs := make(chan error, 1)
+	s.OnError = func(err error) {
+		errs <- err
+	}
+
+	slow := NewSubscriberWithOptions("slow", SubscriberOptions{SlowTimeout: time.Millisecond * 200})
+	s.addSubscriber(slow)
+	slow.Connect()
+
+	fast := NewSubscriber("fast")
+	s.addSubscriber(fast)
+	c := fast.Connect()
+
+	for i := 0; i < 100; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+		<-c
+	}
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrSlowConsumer)
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber was not evicted")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Len(t, s.subscribers, 1)
+	assert.Equal(t, fast.ID(), s.subscribers[0].ID())
+}
+
+func TestStreamOnSubscribeReplayCount(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	counts := make(chan int, 2)
+	s.OnSubscribe = func(sub *Subscriber, replayed int) {
+		assert.Equal(t, "test", sub.Key())
+		counts <- replayed
+	}
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	sub.Connect()
+
+	assert.Equal(t, 0, <-counts)
+
+	for i := 0; i < 5; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	sub.Connect()
+
+	assert.Equal(t, 5, <-counts)
+}
+
+func TestStreamPublishWhere(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	keys := []string{"tenant-7:a", "tenant-7:b", "tenant-8:a"}
+	conns := make(map[string]chan *Event)
+	for _, key := range keys {
+		sub := NewSubscriber(key)
+		s.addSubscriber(sub)
+		conns[key] = sub.Connect()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	e := &Event{Data: []byte("tenant")}
+	s.PublishWhere(func(sub *Subscriber) bool {
+		return strings.HasPrefix(sub.Key(), "tenant-7:")
+	}, e)
+	s.PublishTo("tenant-8:a", &Event{Data: []byte("direct")})
+
+	assert.Equal(t, "tenant", string((<-conns["tenant-7:a"]).Data))
+	assert.Equal(t, "tenant", string((<-conns["tenant-7:b"]).Data))
+	assert.Equal(t, "direct", string((<-conns["tenant-8:a"]).Data))
+
+	time.Sleep(time.Millisecond * 100)
+
+	for _, c := range conns {
+		assert.Len(t, c, 0)
+	}
+	assert.Len(t, s.History(), 0)
+
+	// the targeted event is left untouched, so can be sent to everyone
+	s.publish(e)
+	for _, key := range keys {
+		assert.Equal(t, "tenant", string((<-conns[key]).Data))
+	}
+	assert.Len(t, s.History(), 1)
+}
+
+func TestStreamCloseIdleConnection(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	opts := SubscriberOptions{IdleTimeout: time.Millisecond * 200}
+
+	isub := NewSubscriberWithOptions("idle", opts)
+	s.addSubscriber(isub)
+	idle := isub.Connect()
+
+	asub := NewSubscriberWithOptions("active", opts)
+	s.addSubscriber(asub)
+	active := asub.Connect()
+
+	for i := 0; i < 8; i++ {
+		time.Sleep(time.Millisecond * 50)
+		s.PublishTo("active", &Event{Data: []byte("ping")})
+	}
+
+	_, ok := <-idle
+	assert.False(t, ok)
+	assert.False(t, isub.HasConnections())
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.True(t, asub.HasConnections())
+	assert.Len(t, active, 8)
+	assert.Len(t, s.subscribers, 2)
+}
+
+func TestStreamReplayNoDuplicates(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 50; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+
+	go func() {
+		for i := 50; i < 100; i++ {
+			s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+		}
+	}()
+
+	c := sub.Connect()
+
+	for i := 0; i < 100; i++ {
+		select {
+		case e := <-c:
+			assert.Equal(t, strconv.Itoa(i), string(e.Data))
+			assert.Equal(t, i, e.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("missing event %d", i)
+		}
+	}
+
+	select {
+	case e := <-c:
+		t.Fatalf("unexpected event %d", e.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestStreamControlQueries(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+
+	sub1 := NewSubscriber("test-1")
+	sub2 := NewSubscriber("test-2")
+	s.addSubscriber(sub1)
+	s.addSubscriber(sub2)
+
+	for i := 0; i < 3; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, 2, s.SubscriberCount())
+	stats := s.Stats()
+	assert.True(t, stats.UntilReap > 0 && stats.UntilReap <= DefaultMaxInactivity)
+	stats.UntilReap = 0
+	assert.Equal(t, StreamStats{Subscribers: 2, LogSize: 3, TotalPublished: 3}, stats)
+
+	s.PublishTo("test-1", &Event{Data: []byte("direct")})
+
+	time.Sleep(time.Millisecond * 100)
+
+	stats = s.Stats()
+	stats.UntilReap = 0
+	assert.Equal(t, StreamStats{Subscribers: 2, LogSize: 3, TotalPublished: 4}, stats)
+	assert.Equal(t, []string{sub1.ID(), sub2.ID()}, s.SubscriberIDs())
+
+	s.close()
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, 0, s.SubscriberCount())
+	assert.Nil(t, s.SubscriberIDs())
+}
+
+func TestStreamHasSubscriber(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+
+	sub := NewSubscriber("alice")
+	assert.False(t, s.HasSubscriber(sub.ID()))
+
+	s.addSubscriber(sub)
+	assert.False(t, s.HasSubscriber(sub.ID()))
+
+	c1 := sub.Connect()
+	c2 := sub.Connect()
+	assert.True(t, s.HasSubscriber(sub.ID()))
+	assert.False(t, s.HasSubscriber("alice"))
+
+	sub.Disconnect(c1)
+	assert.True(t, s.HasSubscriber(sub.ID()))
+
+	sub.Disconnect(c2)
+	assert.False(t, s.HasSubscriber(sub.ID()))
+
+	sub.Connect()
+	assert.True(t, s.HasSubscriber(sub.ID()))
+
+	sub.Close()
+	time.Sleep(time.Millisecond * 100)
+	assert.False(t, s.HasSubscriber(sub.ID()))
+
+	s.close()
+	assert.False(t, s.HasSubscriber(sub.ID()))
+}
+
+func TestStreamSubscribers(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	before := time.Now()
+
+	sub := NewSubscriberWithOptions("test", SubscriberOptions{Metadata: map[string]string{"room": "lobby"}})
+	s.addSubscriber(sub)
+	sub.Connect()
+	sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	infos := s.Subscribers()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, sub.ID(), infos[0].ID)
+	assert.Equal(t, "test", infos[0].Key)
+	assert.Equal(t, 2, infos[0].Connections)
+	assert.Equal(t, "lobby", infos[0].Metadata["room"])
+	assert.True(t, infos[0].JoinedAt.After(before))
+
+	infos[0].Metadata["room"] = "changed"
+	assert.Equal(t, "lobby", s.Subscribers()[0].Metadata["room"])
+}
+
+func TestStreamProducer(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	p := s.Producer()
+	for i := 0; i < 3; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				p <- &Event{Data: []byte("ping")}
+			}
+		}()
+	}
+
+	for i := 0; i < 30; i++ {
+		assert.Equal(t, "ping", string((<-c).Data))
+	}
+
+	s.close()
+
+	select {
+	case p <- &Event{Data: []byte("late")}:
+	case <-s.Done():
+	}
+}
+
+func TestStreamProducerLimits(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	errs := make(chan error, 1)
+	s.OnError = func(err error) {
+		errs <- err
+	}
+	s.MaxEventSize = 10
+
+	s.Producer() <- &Event{Data: []byte("far too large for the limit")}
+	assert.Equal(t, ErrEventTooLarge, <-errs)
+
+	s.Producer() <- &Event{Data: []byte("ok")}
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(t, s.History(), 1)
+}
+
+func TestStreamConnectionTiming(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	timings := make(chan ConnectionTiming, 1)
+	s.OnConnectionTiming = func(c *Connection, t ConnectionTiming) {
+		timings <- t
+	}
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("live")})
+
+	for i := 0; i < 4; i++ {
+		<-c
+	}
+
+	timing := <-timings
+	assert.False(t, timing.RegisteredAt.IsZero())
+	assert.False(t, timing.ReplayDoneAt.Before(timing.RegisteredAt))
+	assert.True(t, timing.FirstLiveAt.After(timing.ReplayDoneAt))
+	assert.Equal(t, timing, sub.connections[0].Timing())
+}
+
+func TestStreamSetLog(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	fp := s.Fingerprint()
+
+	s.ResetLog()
+	assert.Len(t, s.History(), 0)
+	assert.NotEqual(t, fp, s.Fingerprint())
+
+	events := []*Event{{Data: []byte("a")}, {Data: []byte("b")}}
+	s.SetLog(events)
+
+	// ids continue from the replaced events, and the given events are
+	// left unchanged
+	history := s.History()
+	assert.Len(t, history, 2)
+	assert.Equal(t, 3, history[0].ID)
+	assert.Equal(t, 4, history[1].ID)
+	assert.Equal(t, 0, events[0].ID)
+
+	s.publish(&Event{Data: []byte("c")})
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	assert.Equal(t, "a", string((<-c).Data))
+	assert.Equal(t, "b", string((<-c).Data))
+	assert.Equal(t, 5, (<-c).ID)
+}
+
+func TestStreamOnBroadcastComplete(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	type tally struct{ delivered, failed int }
+	tallies := make(chan tally, 2)
+	s.OnBroadcastComplete = func(e *Event, delivered, failed int) {
+		tallies <- tally{delivered, failed}
+	}
+
+	active := NewSubscriber("active")
+	s.addSubscriber(active)
+	active.Connect()
+
+	once := NewSubscriberWithOptions("once", SubscriberOptions{AutoClose: true, MaxEvents: 1})
+	s.addSubscriber(once)
+	once.Connect()
+
+	s.addSubscriber(NewSubscriber("disconnected"))
+
+	filtered := NewSubscriberWithOptions("filtered", SubscriberOptions{Filter: func(e *Event) bool { return false }})
+	s.addSubscriber(filtered)
+	filtered.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("1")})
+	assert.Equal(t, tally{2, 1}, <-tallies)
+
+	// the auto closed subscriber has deregistered
+	time.Sleep(time.Millisecond * 100)
+
+	s.publish(&Event{Data: []byte("2")})
+	assert.Equal(t, tally{1, 1}, <-tallies)
+}
+
+func TestStreamReplayMaxAge(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.publish(&Event{Data: []byte("short"), MaxAge: time.Millisecond * 50})
+	s.publish(&Event{Data: []byte("long"), MaxAge: time.Hour})
+	s.publish(&Event{Data: []byte("forever")})
+
+	time.Sleep(time.Millisecond * 100)
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	assert.Equal(t, "long", string((<-c).Data))
+	assert.Equal(t, "forever", string((<-c).Data))
+
+	s.publish(&Event{Data: []byte("live"), MaxAge: time.Nanosecond})
+	assert.Equal(t, "live", string((<-c).Data))
+	assert.Len(t, s.History(), 4)
+}
+
+func TestStreamReplayOrder(t *testing.T) {
+	for _, order := range []ReplayOrder{Ascending, Descending} {
+		s := newStream(DefaultBufferSize)
+		s.ReplayOrder = order
+
+		for i := 0; i < 3; i++ {
+			s.publish(&Event{Data: []byte(strconv.Itoa(i))})
+		}
+
+		time.Sleep(time.Millisecond * 100)
+
+		sub := NewSubscriber("test")
+		s.addSubscriber(sub)
+		c := sub.ConnectAtID("1")
+
+		var received []string
+		for i := 0; i < 2; i++ {
+			received = append(received, string((<-c).Data))
+		}
+
+		if order == Ascending {
+			assert.Equal(t, []string{"1", "2"}, received)
+		} else {
+			assert.Equal(t, []string{"2", "1"}, received)
+		}
+
+		s.close()
+	}
+}
+
+func TestSubscriberConnectionMetadata(t *testing.T) {
+	sub := NewSubscriber("test")
+
+	sub.Connect()
+	sub.ConnectWithMetadata("0", ConnectionMetadata{UserAgent: "phone", RemoteAddr: "10.0.0.1:1234"})
+
+	assert.Equal(t, 2, sub.ConnectionCount())
+
+	md := sub.ConnectionMetadata()
+	assert.Equal(t, "", md[0].UserAgent)
+	assert.False(t, md[0].ConnectedAt.IsZero())
+	assert.Equal(t, "phone", md[1].UserAgent)
+	assert.Equal(t, "10.0.0.1:1234", md[1].RemoteAddr)
+}
+
+func TestStreamSubscriberNames(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	alice := NewSubscriberWithOptions("a", SubscriberOptions{Name: "alice"})
+	s.addSubscriber(alice)
+	s.addSubscriber(NewSubscriber("b"))
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, []string{"alice"}, s.Stats().SubscriberNames)
+	assert.Equal(t, "alice", s.Subscribers()[0].Name)
+
+	err := &SubscriberError{SubscriberID: alice.ID(), SubscriberName: alice.Name(), Err: ErrSlowConsumer}
+	assert.Equal(t, ErrSlowConsumer.Error()+": "+alice.ID()+" (alice)", err.Error())
+}
+
+func TestStreamKeyFunc(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	var calls int32
+	s.KeyFunc = func(e *Event) string {
+		atomic.AddInt32(&calls, 1)
+		return e.Event + ":" + e.Fields["entity"]
+	}
+
+	publish := func(event, entity, data string) {
+		s.publish(&Event{Event: event, Data: []byte(data), Fields: map[string]string{"entity": entity}})
+	}
+
+	publish("user", "1", "alice")
+	publish("user", "2", "bob")
+	publish("order", "1", "pending")
+	publish("user", "1", "alice smith")
+	publish("order", "1", "shipped")
+
+	time.Sleep(time.Millisecond * 100)
+
+	history := s.History()
+	assert.Len(t, history, 3)
+	assert.Equal(t, "bob", string(history[0].Data))
+	assert.Equal(t, "alice smith", string(history[1].Data))
+	assert.Equal(t, "shipped", string(history[2].Data))
+	assert.Equal(t, 4, history[2].ID)
+
+	publish("user", "3", "carol")
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, 5, s.History()[3].ID)
+
+	// each event's key is found once, when it is logged
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+}
+
+func TestStreamReplayFilter(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	for i, name := range []string{"chat", "presence", "chat", "typing", "chat"} {
+		s.publish(&Event{Event: name, Data: []byte(strconv.Itoa(i))})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	sub := NewSubscriberWithOptions("test", SubscriberOptions{Filter: func(e *Event) bool {
+		return e.Event == "chat"
+	}})
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	assert.Equal(t, "0", string((<-c).Data))
+	assert.Equal(t, "2", string((<-c).Data))
+	assert.Equal(t, "4", string((<-c).Data))
+
+	s.publish(&Event{Event: "presence", Data: []byte("5")})
+	s.publish(&Event{Event: "chat", Data: []byte("6")})
+
+	assert.Equal(t, "6", string((<-c).Data))
+}
+
+func TestStreamMaxEventSize(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.MaxEventSize = 64
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	big := &Event{Data: []byte(strings.Repeat("x", 100))}
+	assert.Equal(t, ErrEventTooLarge, s.Publish(big))
+	assert.Equal(t, ErrEventTooLarge, s.PublishSync(big))
+	assert.Nil(t, s.Publish(&Event{Data: []byte("small")}))
+
+	assert.Equal(t, "small", string((<-c).Data))
+
+	select {
+	case e := <-c:
+		t.Fatalf("unexpected event %d", e.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	assert.Len(t, s.History(), 1)
+}
+
+func TestStreamPublishBatch(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.publish(&Event{Event: "single"})
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		batch := make([]*Event, 10)
+		for j := range batch {
+			batch[j] = &Event{Event: "batch", Data: []byte(strconv.Itoa(j))}
+		}
+		assert.Nil(t, s.PublishBatch(batch))
+	}
+
+	wg.Wait()
+
+	// every batch arrives whole, in order
+	for n := 0; n < 250; n++ {
+		e := <-c
+		if e.Event != "batch" {
+			continue
+		}
+
+		assert.Equal(t, "0", string(e.Data))
+		for j := 1; j < 10; j++ {
+			e = <-c
+			n++
+			assert.Equal(t, "batch", e.Event)
+			assert.Equal(t, strconv.Itoa(j), string(e.Data))
+		}
+	}
+
+	assert.Len(t, s.History(), 250)
+	assert.Nil(t, s.PublishBatch(nil))
+
+	s.MaxEventSize = 16
+	err := s.PublishBatch([]*Event{{Data: []byte("ok")}, {Data: []byte(strings.Repeat("x", 32))}})
+	assert.Equal(t, ErrEventTooLarge, err)
+}
+
+func TestStreamPublishSync(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+
+	subs := make([]*Subscriber, 3)
+	for i := range subs {
+		subs[i] = NewSubscriber(strconv.Itoa(i))
+		s.addSubscriber(subs[i])
+		subs[i].Connect()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Nil(t, s.PublishSync(&Event{Data: []byte("barrier")}))
+
+	for i := range subs {
+		assert.Len(t, subs[i].connections[0].conn, 1)
+	}
+
+	s.close()
+
+	assert.Equal(t, ErrStreamClosed, s.PublishSync(&Event{Data: []byte("late")}))
+}
+
+func TestStreamCloseEvents(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.EmitCloseEvents = true
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	sub.DisconnectAllWithReason(ReasonAuthRevoked)
+
+	e := <-c
+	assert.Equal(t, CloseEvent, e.Event)
+	assert.Equal(t, `{"reason":"auth_revoked"}`, string(e.Data))
+
+	_, ok := <-c
+	assert.False(t, ok)
+}
+
+func TestStreamAutoCloseSubscriber(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub := NewSubscriberWithOptions("test", SubscriberOptions{AutoClose: true, MaxEvents: 2})
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 5; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	var received []string
+	for e := range c {
+		received = append(received, string(e.Data))
+	}
+
+	assert.Equal(t, []string{"0", "1"}, received)
+	assert.Equal(t, 0, s.SubscriberCount())
+}
+
+func BenchmarkStreamPublish(b *testing.B) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.AutoReplay = false
+
+	conns := make([]chan *Event, 10)
+	for i := range conns {
+		sub := NewSubscriber(strconv.Itoa(i))
+		s.addSubscriber(sub)
+		conns[i] = sub.Connect()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	e := &Event{Data: []byte("ping")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.event <- e
+		for _, c := range conns {
+			<-c
+		}
+	}
+}
+
+func BenchmarkSubscriberBroadcast(b *testing.B) {
+	sub := NewSubscriber("test")
+	c := &Connection{conn: make(chan *Event, 1)}
+	sub.connections = append(sub.connections, c)
+
+	e := &Event{Data: []byte("ping")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sub.Broadcast(e)
+		<-c.conn
+	}
+}
+
+func TestSubscriberReplay(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	for i := 0; i < 5; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, strconv.Itoa(i), string((<-c).Data))
+	}
+
+	sub.Replay()
+
+	go func() {
+		for i := 5; i < 10; i++ {
+			s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case e := <-c:
+			assert.Equal(t, strconv.Itoa(i), string(e.Data))
+		case <-time.After(time.Second):
+			t.Fatalf("missing event %d", i)
+		}
+	}
+
+	select {
+	case e := <-c:
+		t.Fatalf("unexpected event %d", e.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSubscriberAddConnection(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub := NewSubscriberWithOptions("test", SubscriberOptions{Filter: func(e *Event) bool {
+		return e.Event != "typing"
+	}})
+	s.addSubscriber(sub)
+	first := sub.Connect()
+
+	for i, name := range []string{"chat", "typing", "chat"} {
+		s.publish(&Event{Event: name, Data: []byte(strconv.Itoa(i))})
+	}
+
+	assert.Equal(t, "0", string((<-first).Data))
+	assert.Equal(t, "2", string((<-first).Data))
+
+	second := sub.AddConnection(ConnectionMetadata{UserAgent: "tab"})
+
+	assert.Equal(t, "0", string((<-second).Data))
+	assert.Equal(t, "2", string((<-second).Data))
+
+	s.publish(&Event{Event: "chat", Data: []byte("3")})
+
+	// the first connection is not replayed to again
+	assert.Equal(t, "3", string((<-first).Data))
+	assert.Equal(t, "3", string((<-second).Data))
+
+	select {
+	case e := <-first:
+		t.Fatalf("unexpected event %d", e.ID)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	assert.Equal(t, 2, sub.ConnectionCount())
+}
+
+func TestStreamOnReap(t *testing.T) {
+	s := newConfiguredStream(DefaultBufferSize, StreamConfig{MaxInactivity: time.Millisecond * 50})
+	s.EmitCloseEvents = true
+
+	var reaped int32
+	s.OnReap = func() {
+		// the stream has not closed yet
+		select {
+		case <-s.done:
+			t.Error("stream closed before OnReap")
+		default:
+		}
+		atomic.AddInt32(&reaped, 1)
+	}
+
+	sub := NewSubscriber("test")
+	s.run()
+	assert.Nil(t, s.addSubscriber(sub))
+
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("stream was not reaped")
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reaped))
+	assert.Nil(t, s.getSubscriber("test"))
+}
+
+func TestStreamDrainBatch(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.DrainBatch = 8
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	for i := 0; i < 20; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, strconv.Itoa(i), string((<-c).Data))
+	}
+
+	// requests are still answered between batches
+	assert.Len(t, s.History(), 20)
+}
+
+func BenchmarkStreamDrainBatch(b *testing.B) {
+	for _, n := range []int{0, 16, 64, 256} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			s := newStream(DefaultBufferSize)
+			defer s.close()
+
+			s.AutoReplay = false
+			s.DrainBatch = n
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				sub := NewSubscriber(strconv.Itoa(i))
+				s.addSubscriber(sub)
+				c := sub.Connect()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < b.N; i++ {
+						<-c
+					}
+				}()
+			}
+
+			time.Sleep(time.Millisecond * 100)
+
+			e := &Event{Data: []byte("ping")}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.event <- e
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkStreamDeregister(b *testing.B) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	// registered directly, so the run loop is not involved
+	subs := make([]*Subscriber, 100000)
+	for i := range subs {
+		subs[i] = NewSubscriber(strconv.Itoa(i))
+		s.appendSubscriber(subs[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sub := subs[(i*7919)%len(subs)]
+		s.removeSubscriber(s.getSubscriberIndex(sub), ReasonNone)
+		s.appendSubscriber(sub)
+	}
+}
+
+func TestStreamCatchUpCompleteEvent(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.CatchUpCompleteEvent = &Event{Event: DefaultCatchUpEvent}
+
+	for i := 0; i < 3; i++ {
+		s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+	}
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+
+	go func() {
+		for i := 3; i < 6; i++ {
+			s.event <- &Event{Data: []byte(strconv.Itoa(i))}
+		}
+	}()
+
+	c := sub.Connect()
+
+	var caughtUp bool
+	for i := 0; i < 6; {
+		e := <-c
+		if e.Event == DefaultCatchUpEvent {
+			assert.False(t, caughtUp)
+			assert.GreaterOrEqual(t, i, 3)
+			caughtUp = true
+			continue
+		}
+		assert.Equal(t, strconv.Itoa(i), string(e.Data))
+		i++
+	}
+
+	assert.True(t, caughtUp)
+	assert.Len(t, s.History(), 6)
+
+	// dropping the event for one connection does not drop it for others
+	catchUp := func() *Event {
+		c := sub.Connect()
+		for {
+			if e := <-c; e.Event == DefaultCatchUpEvent {
+				return e
+			}
+		}
+	}
+
+	catchUp().drop()
+	assert.False(t, catchUp().isDropped())
+	assert.False(t, s.CatchUpCompleteEvent.isDropped())
+}
+
+func TestStreamCompressLog(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.CompressLog = true
+
+	data := strings.Repeat(`{"status":"ok"}`, 100)
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte(data)})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	reply := make(chan LogUsage, 1)
+	s.control(logUsageReq{reply: reply})
+	u := <-reply
+	assert.Equal(t, 3, u.Events)
+	assert.True(t, u.Bytes < len(data))
+
+	history := s.History()
+	assert.Len(t, history, 3)
+	assert.Equal(t, data, string(history[0].Data))
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	for i := 0; i < 3; i++ {
+		e := <-c
+		assert.Equal(t, i, e.ID)
+		assert.Equal(t, data, string(e.Data))
+	}
+
+	// the compressed eventlog fingerprints as an uncompressed one does
+	plain := newStream(DefaultBufferSize)
+	defer plain.close()
+
+	plain.SetLog(history)
+	assert.Equal(t, s.Fingerprint(), plain.Fingerprint())
+}
+
+func BenchmarkEventLogReplay(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run("CompressLog="+strconv.FormatBool(compress), func(b *testing.B) {
+			data := []byte(strings.Repeat(`{"id":12345,"status":"ok","tags":["a","b"]}`, 100))
+
+			var log EventLog
+			var size int
+			for i := 0; i < 100; i++ {
+				e := &Event{Data: data}
+				log.Add(e)
+				if compress {
+					log[i] = e.compressed()
+				}
+				size += len(log[i].Data)
+			}
+
+			c := &Connection{conn: make(chan *Event, len(log)), eventid: "0"}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				log.replay(c, Ascending)
+				for len(c.conn) > 0 {
+					<-c.conn
+				}
+			}
+
+			b.ReportMetric(float64(size)/float64(len(log)), "logbytes/event")
+		})
+	}
+}
+
+func TestStreamApplyDelta(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.KeyFunc = func(e *Event) string {
+		return e.Fields["entity"]
+	}
+	s.ApplyDelta = func(base, delta *Event) (*Event, error) {
+		if string(delta.Data) == "bad" {
+			return nil, errors.New("invalid delta")
+		}
+		return &Event{Data: append(append([]byte{}, base.Data...), delta.Data...), Fields: base.Fields}, nil
+	}
+
+	publish := func(entity, data string, delta bool) {
+		s.publish(&Event{Data: []byte(data), Delta: delta, Fields: map[string]string{"entity": entity}})
+	}
+
+	publish("a", "1", false)
+	publish("b", "x", false)
+	publish("a", "2", true)
+	publish("a", "3", true)
+	publish("b", "bad", true)
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Len(t, s.History(), 5)
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	var replayed []string
+	for i := 0; i < 3; i++ {
+		e := <-c
+		replayed = append(replayed, strconv.Itoa(e.ID)+":"+string(e.Data))
+	}
+	assert.Equal(t, []string{"1:x", "3:123", "4:bad"}, replayed)
+
+	// a full event replaces the state it builds on
+	publish("a", "9", false)
+	assert.Equal(t, "9", string((<-c).Data))
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Len(t, s.History(), 3)
+}
+
+func TestStreamSnapshot(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.KeyFunc = func(e *Event) string {
+		return e.Event
+	}
+	s.Snapshot = func(events []*Event) *Event {
+		state := make([]string, len(events))
+		for i := range events {
+			state[i] = events[i].Event + "=" + string(events[i].Data)
+		}
+		return &Event{Event: "snapshot", Data: []byte(strings.Join(state, ","))}
+	}
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}} {
+		s.publish(&Event{Event: kv[0], Data: []byte(kv[1])})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	e := <-c
+	assert.Equal(t, "snapshot", e.Event)
+	assert.Equal(t, "b=2,a=3", string(e.Data))
+	assert.Equal(t, 2, e.ID)
+
+	s.publish(&Event{Event: "b", Data: []byte("4")})
+
+	e = <-c
+	assert.Equal(t, "b", e.Event)
+	assert.Equal(t, 3, e.ID)
+}
+
+func TestStreamConnections(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.AutoReplay = false
+
+	idle := NewSubscriber("idle")
+	s.addSubscriber(idle)
+	ci := idle.ConnectWithMetadata("0", ConnectionMetadata{RemoteAddr: "10.0.0.1:5000"})
+
+	active := NewSubscriber("active")
+	s.addSubscriber(active)
+	ca := active.Connect()
+
+	time.Sleep(time.Millisecond * 100)
+
+	s.PublishTo("active", &Event{Data: []byte("ping")})
+	<-ca
+
+	infos := s.Connections()
+	assert.Len(t, infos, 2)
+
+	// prune connections without a write in the last 50ms
+	for _, info := range infos {
+		assert.False(t, info.ConnectedAt.IsZero())
+		if time.Since(info.LastWriteAt) > time.Millisecond*50 {
+			assert.Equal(t, idle.ID(), info.SubscriberID)
+			assert.Equal(t, "10.0.0.1:5000", info.RemoteAddr)
+			assert.Nil(t, s.CloseConnection(info.SubscriberID, info.ConnID, ReasonIdle))
+		}
+	}
+
+	_, ok := <-ci
+	assert.False(t, ok)
+	assert.Len(t, s.Connections(), 1)
+	assert.Equal(t, active.ID(), s.Connections()[0].SubscriberID)
+}
+
+func TestStreamCloseConnection(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.EmitCloseEvents = true
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	first := sub.connect("0", "", ConnectionMetadata{})
+	second := sub.connect("0", "", ConnectionMetadata{})
+	assert.NotEqual(t, first.ID(), second.ID())
+
+	assert.Equal(t, ErrSubscriberNotFound, s.CloseConnection("missing", first.ID(), ReasonNone))
+	assert.Equal(t, ErrConnectionNotFound, s.CloseConnection(sub.ID(), "missing", ReasonNone))
+
+	abuse := DisconnectReason("abuse")
+	assert.Nil(t, s.CloseConnection(sub.ID(), first.ID(), abuse))
+
+	assert.Equal(t, string(abuse.event().Data), string((<-first.conn).Data))
+	_, ok := <-first.conn
+	assert.False(t, ok)
+	assert.Equal(t, 1, sub.ConnectionCount())
+	assert.Equal(t, 1, s.SubscriberCount())
+
+	// closing the last connection removes the subscriber
+	assert.Nil(t, s.CloseConnection(sub.ID(), second.ID(), abuse))
+	assert.Equal(t, CloseEvent, (<-second.conn).Event)
+	assert.Equal(t, 0, s.SubscriberCount())
+}
+
+func TestSubscriberDedupWindow(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	sub := NewSubscriberWithOptions("test", SubscriberOptions{DedupWindow: 2})
+	s.addSubscriber(sub)
+	c := sub.connect("0", "", ConnectionMetadata{})
+
+	for _, id := range []int{1, 1, 2, 0, 0, 1, 3, 1} {
+		c.Send(&Event{ID: id})
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	var ids []int
+	for len(c.conn) > 0 {
+		ids = append(ids, (<-c.conn).ID)
+	}
+
+	// 1 is delivered again once it has left the window
+	assert.Equal(t, []int{1, 2, 0, 0, 3, 1}, ids)
+}
+
+func TestStreamSummarize(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	s.SummaryInterval = time.Millisecond * 100
+	s.Summarize = func(recent []*Event) *Event {
+		return &Event{Data: []byte(strconv.Itoa(len(recent)))}
+	}
+
+	sub := NewSubscriberWithOptions("dashboard", SubscriberOptions{
+		Filter: func(e *Event) bool {
+			return e.Event == DefaultSummaryEvent
+		},
+	})
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	time.Sleep(time.Millisecond * 10)
+
+	for i := 0; i < 5; i++ {
+		s.publish(&Event{Data: []byte("tick")})
+	}
+
+	e := <-c
+	assert.Equal(t, DefaultSummaryEvent, e.Event)
+	assert.Equal(t, "5", string(e.Data))
+	assert.Len(t, s.History(), 5)
+
+	s.publish(&Event{Data: []byte("tick")})
+
+	assert.Equal(t, "1", string((<-c).Data))
+}
+
+func TestStreamDowngrades(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	// version 2 renamed the name field to full_name
+	s.Downgrades = map[int]VersionTransform{
+		2: func(e *Event) *Event {
+			data := strings.Replace(string(e.Data), `"full_name"`, `"name"`, 1)
+			return &Event{Event: e.Event, Data: []byte(data)}
+		},
+	}
+
+	s.publish(&Event{Version: 2, Data: []byte(`{"full_name":"alice"}`)})
+
+	time.Sleep(time.Millisecond * 100)
+
+	v1 := NewSubscriberWithOptions("v1", SubscriberOptions{MaxVersion: 1})
+	s.addSubscriber(v1)
+	c1 := v1.Connect()
+
+	v2 := NewSubscriberWithOptions("v2", SubscriberOptions{MaxVersion: 2})
+	s.addSubscriber(v2)
+	c2 := v2.Connect()
+
+	e := <-c1
+	assert.Equal(t, `{"name":"alice"}`, string(e.Data))
+	assert.Equal(t, 1, e.Version)
+	assert.Equal(t, 0, e.ID)
+	assert.Equal(t, `{"full_name":"alice"}`, string((<-c2).Data))
+
+	// there is no way to convert version 3 events, so v1 and v2 skip them
+	s.publish(&Event{Version: 3, Data: []byte("new")})
+	s.publish(&Event{Version: 2, Data: []byte(`{"full_name":"bob"}`)})
+
+	assert.Equal(t, `{"name":"bob"}`, string((<-c1).Data))
+	assert.Equal(t, `{"full_name":"bob"}`, string((<-c2).Data))
+
+	assert.Equal(t, 1, acceptVersion("text/event-stream, application/json; version=1"))
+	assert.Equal(t, 0, acceptVersion("application/json"))
+}
+
+type backlogRecorder struct {
+	mu      sync.Mutex
+	reports []Backlog
+}
+
+func (m *backlogRecorder) SubscriberEvicted(sub *Subscriber) {}
+
+func (m *backlogRecorder) StreamBacklog(str *Stream, b Backlog) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports = append(m.reports, b)
+}
+
+func (m *backlogRecorder) last() (Backlog, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.reports) == 0 {
+		return Backlog{}, false
+	}
+	return m.reports[len(m.reports)-1], true
+}
+
+func TestStreamBacklog(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	m := &backlogRecorder{}
+	s.Metrics = m
+	s.BacklogInterval = time.Millisecond * 20
+
+	sub := NewSubscriber("test")
+	s.addSubscriber(sub)
+	c := sub.Connect()
+
+	assert.Equal(t, 0, s.Stats().QueuedEvents)
+
+	for i := 0; i < 3; i++ {
+		s.publish(&Event{Data: []byte("ping")})
+	}
+
+	// the events are aged from when they were queued, so wait for that
+	// before sleeping and allow for clock jitter
+	for s.Stats().QueuedEvents < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	stats := s.Stats()
+	assert.Equal(t, 3, stats.QueuedEvents)
+	assert.True(t, stats.OldestQueuedAge >= time.Millisecond*40, stats.OldestQueuedAge)
+	assert.Equal(t, 0, stats.ActiveReplays)
+
+	b, ok := m.last()
+	assert.True(t, ok)
+	assert.Equal(t, 3, b.QueuedEvents)
+
+	for i := 0; i < 3; i++ {
+		<-c
+	}
+
+	stats = s.Stats()
+	assert.Equal(t, 0, stats.QueuedEvents)
+	assert.Equal(t, time.Duration(0), stats.OldestQueuedAge)
+}
+
+func TestStreamExclusiveSubscriber(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	first := NewSubscriberWithOptions("user", SubscriberOptions{Exclusive: true})
+	s.addSubscriber(first)
+	c := first.Connect()
+
+	time.Sleep(time.Millisecond * 50)
+
+	second := NewSubscriberWithOptions("user", SubscriberOptions{Exclusive: true})
+	s.addSubscriber(second)
+
+	e := <-c
+	assert.Equal(t, CloseEvent, e.Event)
+	assert.Equal(t, `{"reason":"superseded"}`, string(e.Data))
+
+	_, ok := <-c
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{second.id}, s.SubscriberIDs())
+
+	// subscribers for other keys are left alone
+	other := NewSubscriberWithOptions("other", SubscriberOptions{Exclusive: true})
+	s.addSubscriber(other)
+	assert.Equal(t, 2, s.SubscriberCount())
+}
+
+func TestStreamExclusiveSubscriberRace(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	subs := make([]*Subscriber, 20)
+	for i := range subs {
+		subs[i] = NewSubscriberWithOptions("user", SubscriberOptions{Exclusive: true})
+	}
+
+	var wg sync.WaitGroup
+	for i := range subs {
+		wg.Add(1)
+		go func(sub *Subscriber) {
+			defer wg.Done()
+			s.addSubscriber(sub)
+		}(subs[i])
+	}
+	wg.Wait()
+
+	ids := s.SubscriberIDs()
+	assert.Len(t, ids, 1)
+
+	var survivors int
+	for i := range subs {
+		if len(ids) == 1 && subs[i].id == ids[0] {
+			survivors++
+		}
+	}
+	assert.Equal(t, 1, survivors)
+}
+
+func TestConnectionCloseWhileDelivering(t *testing.T) {
+	sub := NewSubscriber("test")
+	c := &Connection{conn: make(chan *Event), stop: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// blocks, as nothing reads the connection
+		c.deliver(&Event{Data: []byte("late")})
+		c.deliver(&Event{Data: []byte("later")})
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+	sub.closeConnection(c, ReasonShutdown)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery to a closed connection did not return")
+	}
+
+	_, ok := <-c.conn
+	assert.False(t, ok)
+}
+
+func TestStreamTap(t *testing.T) {
+	s := newStream(DefaultBufferSize)
+	defer s.close()
+
+	tapped := make(chan *Event, 1)
+	s.Tap = func(e *Event) {
+		tapped <- e
+	}
+
+	published := &Event{Data: []byte("ping")}
+	assert.Nil(t, s.PublishSync(published))
+
+	// taps see the logged event, as a copy of their own
+	e := <-tapped
+	assert.Equal(t, 0, e.ID)
+	assert.False(t, e.Timestamp.IsZero())
+	assert.True(t, e != published)
+}
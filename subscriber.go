@@ -5,33 +5,203 @@
 package broadcast
 
 import (
+	"crypto/rand"
+	"fmt"
 	"sync"
+	"time"
 )
 
+// GenerateSubscriberID returns a new unique id for a subscriber. It can be
+// replaced to change how internal subscriber ids are assigned, but every
+// call must return an id that has not been used before.
+var GenerateSubscriberID = newUUID
+
+// SubscriberOptions configures how a subscriber handles delivery
+type SubscriberOptions struct {
+	// SlowTimeout enables buffering of events for connections that are not
+	// keeping up. If a connection is still unable to accept events after
+	// SlowTimeout has elapsed, the subscriber is evicted from the stream.
+	// A zero value blocks delivery until the connection accepts the event.
+	SlowTimeout time.Duration
+	// IdleTimeout is applied to each of the subscribers connections, closing
+	// any that have not had an event written to them for the duration. This
+	// does not deregister the subscriber.
+	IdleTimeout time.Duration
+	// AutoClose deregisters the subscriber from its stream once it has been
+	// sent MaxEvents live events, or a single event if MaxEvents is zero.
+	AutoClose bool
+	MaxEvents int
+	// Filter selects the events the subscriber receives, both live and
+	// replayed from the eventlog. Every event is received when nil.
+	Filter func(e *Event) bool
+	// DedupWindow makes each of the subscribers connections remember the
+	// ids of this many of the events last delivered to it, and drop any
+	// event with one of those ids instead of delivering it again. Events
+	// without an id are always delivered. Disabled when zero.
+	DedupWindow int
+	// MaxVersion is the newest event version the subscriber accepts.
+	// Newer events are converted with the streams Downgrades, or skipped if
+	// they cannot be. Events of any version are accepted when zero.
+	MaxVersion int
+	// Backpressure decides what happens to live events that arrive while
+	// the subscribers connections are full, in place of the streams
+	// Backpressure
+	Backpressure BackpressureStrategy
+	// Tier ranks the subscriber for Stream.TieredDelivery, higher tiers
+	// being delivered to first
+	Tier int
+	// Exclusive makes the subscriber replace any others on the stream with
+	// the same key when it registers. Their connections are closed with
+	// ReasonSuperseded, which is sent even if the stream does not
+	// EmitCloseEvents. Subscribers without a key are never replaced.
+	Exclusive bool
+	// Name is a human readable name for the subscriber, shown in stats,
+	// errors and Stream.Subscribers. It is not used to identify it.
+	Name string
+	// Metadata is arbitrary information about the subscriber, such as the
+	// room it has joined, reported by Stream.Subscribers
+	Metadata map[string]string
+}
+
 // Subscriber ...
 type Subscriber struct {
-	id          string
+	// unique internal id, used to identify the subscriber on a stream
+	id string
+	// optional external key supplied by the client, used to address it
+	key         string
+	options     SubscriberOptions
 	quit        chan *Subscriber
 	replay      chan *Connection
+	done        chan struct{}
 	connections []*Connection
-	mu          sync.Mutex
+	received    int
+	stop        chan struct{}
+	// send a close event to connections before closing them
+	closeEvents bool
+	// converts events to earlier versions, from the streams Downgrades
+	downgrades map[int]VersionTransform
+	// the streams Backpressure
+	backpressure BackpressureStrategy
+	// sends on quit unless the stream has closed it, from Stream.send
+	send func(func() bool) bool
+	// saves acked offsets, from the servers Offsets. acked is the id after
+	// the last acked event
+	offsets OffsetStore
+	acked   int
+	// when the subscriber was registered on its stream
+	joined time.Time
+	mu     sync.Mutex
 }
 
-// NewSubscriber creates a new subscriber with defaults
-func NewSubscriber(id string) *Subscriber {
+// NewSubscriber creates a new subscriber with defaults. The key is an
+// external identifier that can be shared by several subscribers and is used
+// to look them up, while each subscriber is given its own unique id.
+func NewSubscriber(key string) *Subscriber {
+	return NewSubscriberWithOptions(key, SubscriberOptions{})
+}
+
+// NewSubscriberWithOptions creates a new subscriber with the given options
+func NewSubscriberWithOptions(key string, opts SubscriberOptions) *Subscriber {
 	return &Subscriber{
-		id:          id,
+		id:          GenerateSubscriberID(),
+		key:         key,
+		options:     opts,
 		connections: make([]*Connection, 0),
 	}
 }
 
+// ID returns the subscribers unique internal id
+func (s *Subscriber) ID() string {
+	return s.id
+}
+
+// Name returns the human readable name the subscriber was given, if any
+func (s *Subscriber) Name() string {
+	return s.options.Name
+}
+
+// Key returns the external key the subscriber was created with
+func (s *Subscriber) Key() string {
+	return s.key
+}
+
 // Broadcast an event to all of a subscribers connections
 func (s *Subscriber) Broadcast(e *Event) {
+	s.broadcast(e)
+}
+
+// delivery is the outcome of broadcasting an event to a subscriber
+type delivery int
+
+const (
+	// none of the subscribers connections accepted the event
+	deliveryFailed delivery = iota
+	deliveryDelivered
+	// the subscriber does not want the event, by its filter or versions
+	deliverySkipped
+)
+
+// broadcast sends an event to all of a subscribers connections, returning
+// whether any of them accepted it, or whether the subscriber skipped it
+func (s *Subscriber) broadcast(e *Event) delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var last bool
+	result := deliveryFailed
+
+	if !s.wants(e) {
+		// filtered out by choice, rather than failed
+		return deliverySkipped
+	}
+
+	if e = s.version(e); e == nil {
+		return deliverySkipped
+	}
+
+	if s.options.AutoClose {
+		if s.received >= s.maxEvents() {
+			return deliveryFailed
+		}
+
+		s.received++
+		last = s.received == s.maxEvents()
+	}
+
+	for i := range s.connections {
+		if s.connections[i].Send(e) {
+			result = deliveryDelivered
+		}
+	}
+
+	if last {
+		// deregister through the stream, as broadcast is called from
+		// within the run loop
+		go s.Close()
+	}
+
+	return result
+}
+
+// wants reports whether the subscribers filter accepts an event
+func (s *Subscriber) wants(e *Event) bool {
+	return s.options.Filter == nil || s.options.Filter(e)
+}
+
+func (s *Subscriber) maxEvents() int {
+	if s.options.MaxEvents > 0 {
+		return s.options.MaxEvents
+	}
+	return 1
+}
+
+// flush signals each of the subscribers connections to flush buffered events
+func (s *Subscriber) flush() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for i := range s.connections {
-		s.connections[i].Send(e)
+		s.connections[i].signalFlush()
 	}
 }
 
@@ -42,21 +212,100 @@ func (s *Subscriber) Connect() chan *Event {
 
 // ConnectAtID creates a new connection and replays events from a given event id
 func (s *Subscriber) ConnectAtID(id string) chan *Event {
+	return s.connect(id, "", ConnectionMetadata{}).conn
+}
+
+// ConnectWithMetadata creates a new connection tagged with information
+// about the client, and replays events from a given event id. The metadata
+// can be read back with Subscriber.ConnectionMetadata.
+func (s *Subscriber) ConnectWithMetadata(id string, md ConnectionMetadata) chan *Event {
+	return s.connect(id, "", md).conn
+}
+
+// ConnectWithFingerprint creates a new connection for a client that already
+// holds the state described by a fingerprint, as returned by
+// Stream.Fingerprint. If it matches the streams current fingerprint, replay
+// is skipped and an UpToDateEvent is sent instead.
+func (s *Subscriber) ConnectWithFingerprint(fingerprint string) chan *Event {
+	return s.connect("0", fingerprint, ConnectionMetadata{}).conn
+}
+
+// AddConnection opens another connection on a subscriber that already has
+// some, such as a second tab, and replays the streams eventlog to it so it
+// catches up with the others. Only the new connection is replayed to, and
+// the replay honours the subscribers filter as any other does.
+func (s *Subscriber) AddConnection(md ConnectionMetadata) chan *Event {
+	return s.ConnectWithMetadata("0", md)
+}
+
+func (s *Subscriber) connect(id, fingerprint string, md ConnectionMetadata) *Connection {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	c := Connection{
-		conn:    make(chan *Event, 64),
-		eventid: id,
+	now := time.Now()
+	if md.ConnectedAt.IsZero() {
+		md.ConnectedAt = now
 	}
 
-	s.connections = append(s.connections, &c)
+	c := &Connection{
+		id:          newUUID(),
+		IdleTimeout: s.options.IdleTimeout,
+		lastWrite:   now,
+		subscriber:  s,
+		conn:        make(chan *Event, 64),
+		eventid:     s.resumeFrom(id),
+		sentID:      -1,
+		fingerprint: fingerprint,
+		replaying:   s.replay != nil,
+		buffered:    s.options.SlowTimeout > 0,
+		flushNow:    make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		timing:      ConnectionTiming{RegisteredAt: now},
+		Metadata:    md,
+	}
 
-	go func() {
-		s.replay <- &c
-	}()
+	if s.options.DedupWindow > 0 {
+		c.dedup = newIDWindow(s.options.DedupWindow)
+	}
+
+	s.connections = append(s.connections, c)
+	s.requestReplay(c)
+
+	return c
+}
+
+// Replay sends the streams entire eventlog to each of the subscribers
+// connections again. Live events that arrive while the replay is pending
+// are held and delivered after it, just as they are for new connections.
+func (s *Subscriber) Replay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replay == nil {
+		return
+	}
 
-	return c.conn
+	for i := range s.connections {
+		c := s.connections[i]
+
+		c.mu.Lock()
+		c.eventid = "0"
+		c.fingerprint = ""
+		c.replaying = true
+		c.mu.Unlock()
+
+		s.requestReplay(c)
+	}
+}
+
+// requestReplay asks the stream to replay its eventlog to a connection
+func (s *Subscriber) requestReplay(c *Connection) {
+	go func(replay chan *Connection, done chan struct{}) {
+		select {
+		case replay <- c:
+		case <-done:
+		}
+	}(s.replay, s.done)
 }
 
 // Disconnect a subscriber connection from the subscriber
@@ -66,25 +315,157 @@ func (s *Subscriber) Disconnect(c chan *Event) {
 
 	for i := len(s.connections) - 1; i >= 0; i-- {
 		if s.connections[i].conn == c {
-			close(c)
+			s.closeConnection(s.connections[i], ReasonNone)
+			s.connections = append(s.connections[:i], s.connections[i+1:]...)
+		}
+	}
+}
+
+// disconnect closes one of the subscribers connections with a reason, if it
+// is still open
+func (s *Subscriber) disconnect(c *Connection, reason DisconnectReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.connections) - 1; i >= 0; i-- {
+		if s.connections[i] == c {
+			s.closeConnection(c, reason)
 			s.connections = append(s.connections[:i], s.connections[i+1:]...)
 		}
 	}
 }
 
+// connection returns the subscribers connection with an id, or nil
+func (s *Subscriber) connection(id string) *Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.connections {
+		if s.connections[i].id == id {
+			return s.connections[i]
+		}
+	}
+
+	return nil
+}
+
 // DisconnectAll closes all subscriber connections
 func (s *Subscriber) DisconnectAll() {
+	s.DisconnectAllWithReason(ReasonNone)
+}
+
+// DisconnectAllWithReason closes all subscriber connections, first sending
+// each a close event with the reason if the stream emits them. See
+// Stream.EmitCloseEvents.
+func (s *Subscriber) DisconnectAllWithReason(reason DisconnectReason) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for i := len(s.connections) - 1; i >= 0; i-- {
 		if s.connections[i] != nil {
-			close(s.connections[i].conn)
+			s.closeConnection(s.connections[i], reason)
 		}
 		s.connections = append(s.connections[:i], s.connections[i+1:]...)
 	}
 }
 
+// closeConnection closes a connection, sending it a close event first if
+// there is room for one
+func (s *Subscriber) closeConnection(c *Connection, reason DisconnectReason) {
+	// superseded clients are always told, so they do not reconnect and
+	// replace their replacement in turn
+	var closeEvent *Event
+	if reason != ReasonNone && (s.closeEvents || reason == ReasonSuperseded) {
+		closeEvent = reason.event()
+	}
+
+	c.close(closeEvent)
+}
+
+// info returns a snapshot of the subscriber
+func (s *Subscriber) info() SubscriberInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := SubscriberInfo{
+		ID:          s.id,
+		Key:         s.key,
+		Name:        s.options.Name,
+		Connections: len(s.connections),
+		JoinedAt:    s.joined,
+	}
+
+	if s.options.Metadata != nil {
+		info.Metadata = make(map[string]string, len(s.options.Metadata))
+		for k, v := range s.options.Metadata {
+			info.Metadata[k] = v
+		}
+	}
+
+	return info
+}
+
+// connectionInfo returns a snapshot of each of the subscribers connections
+func (s *Subscriber) connectionInfo() []ConnectionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]ConnectionInfo, len(s.connections))
+	for i, c := range s.connections {
+		c.mu.Lock()
+		infos[i] = ConnectionInfo{
+			SubscriberID: s.id,
+			ConnID:       c.id,
+			ConnectedAt:  c.Metadata.ConnectedAt,
+			LastWriteAt:  c.lastWrite,
+			RemoteAddr:   c.Metadata.RemoteAddr,
+		}
+		c.mu.Unlock()
+	}
+
+	return infos
+}
+
+// ConnectionCount returns the number of open connections on the subscriber
+func (s *Subscriber) ConnectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.connections)
+}
+
+// ConnectionMetadata returns the metadata of each of the subscribers open
+// connections
+func (s *Subscriber) ConnectionMetadata() []ConnectionMetadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	md := make([]ConnectionMetadata, len(s.connections))
+	for i := range s.connections {
+		md[i] = s.connections[i].Metadata
+	}
+
+	return md
+}
+
+// lastSent returns the id of the newest event sent by any of the
+// subscribers connections, or -1 if none has been
+func (s *Subscriber) lastSent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := -1
+	for i := range s.connections {
+		s.connections[i].mu.Lock()
+		if s.connections[i].sentID > last {
+			last = s.connections[i].sentID
+		}
+		s.connections[i].mu.Unlock()
+	}
+
+	return last
+}
+
 // HasConnections returns true if there are any subscriber connections
 func (s *Subscriber) HasConnections() bool {
 	return len(s.connections) > 0
@@ -93,6 +474,108 @@ func (s *Subscriber) HasConnections() bool {
 // Close will let the stream know that the clients connection has terminated
 func (s *Subscriber) Close() {
 	if s.quit != nil {
-		s.quit <- s
+		s.send(func() bool {
+			select {
+			case s.quit <- s:
+				return true
+			case <-s.done:
+				return false
+			}
+		})
+	}
+}
+
+// watch periodically closes any of the subscribers connections that have
+// been idle for longer than their idle timeout. It also checks whether any
+// have stalled for longer than the slow timeout, sending the subscriber to
+// be evicted if they have.
+func (s *Subscriber) watch(evict chan *Subscriber, done chan struct{}) {
+	interval := s.options.SlowTimeout
+	if interval <= 0 || (s.options.IdleTimeout > 0 && s.options.IdleTimeout < interval) {
+		interval = s.options.IdleTimeout
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	stop := make(chan struct{})
+	s.stop = stop
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.closeIdle()
+				if s.options.SlowTimeout > 0 && s.stalled() {
+					select {
+					case evict <- s:
+					case <-stop:
+					case <-done:
+					}
+					return
+				}
+			case <-stop:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// unwatch stops checking the subscriber for idle and stalled connections
+func (s *Subscriber) unwatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
 	}
 }
+
+func (s *Subscriber) stalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.connections {
+		if s.connections[i].stalled(s.options.SlowTimeout) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// closeIdle closes and removes any idle connections
+func (s *Subscriber) closeIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.connections) - 1; i >= 0; i-- {
+		if s.connections[i].idle() {
+			s.closeConnection(s.connections[i], ReasonIdle)
+			s.connections = append(s.connections[:i], s.connections[i+1:]...)
+		}
+	}
+}
+
+// newUUID returns a random (version 4) uuid
+func newUUID() string {
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,62 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import "time"
+
+// DefaultSummaryEvent is the event type given to summaries that do not set
+// one, see Stream.Summarize
+const DefaultSummaryEvent = "_summary"
+
+// recordSummary keeps an event for the next summary, starting the summary
+// ticker with the first
+func (str *Stream) recordSummary(e *Event) {
+	if str.Summarize == nil || str.SummaryInterval <= 0 || e.match != nil {
+		return
+	}
+
+	if str.summaryTicker == nil {
+		str.summaryTicker = time.NewTicker(str.SummaryInterval)
+	}
+
+	str.recent = append(str.recent, e)
+}
+
+// summaries returns the channel summary ticks are received on, or nil if
+// no summary is due
+func (str *Stream) summaries() <-chan time.Time {
+	if str.summaryTicker == nil {
+		return nil
+	}
+	return str.summaryTicker.C
+}
+
+// summarize broadcasts a summary of the events handled since the last one
+func (str *Stream) summarize() {
+	recent := str.recent
+	str.recent = nil
+
+	e := str.Summarize(recent)
+	if e == nil {
+		return
+	}
+
+	if e.Event == "" {
+		e.Event = DefaultSummaryEvent
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	str.broadcast(e)
+}
+
+// stopSummaries stops the summary ticker
+func (str *Stream) stopSummaries() {
+	if str.summaryTicker != nil {
+		str.summaryTicker.Stop()
+		str.summaryTicker = nil
+	}
+}
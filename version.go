@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broadcast
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// VersionTransform converts an event to the previous version of its
+// schema. It must return a new event rather than modify e, or nil if the
+// event has no equivalent in the previous version.
+type VersionTransform func(e *Event) *Event
+
+// version returns an event converted to a version the subscriber accepts,
+// using the streams Downgrades, or nil if it cannot be
+func (s *Subscriber) version(e *Event) *Event {
+	max := s.options.MaxVersion
+
+	for max > 0 && e != nil && e.Version > max {
+		down := s.downgrades[e.Version]
+		if down == nil {
+			return nil
+		}
+
+		prev := down(e)
+		if prev == nil {
+			return nil
+		}
+
+		prev.ID = e.ID
+		prev.logged = e.logged
+		prev.Version = e.Version - 1
+		if prev.Timestamp.IsZero() {
+			prev.Timestamp = e.Timestamp
+		}
+
+		e = prev
+	}
+
+	return e
+}
+
+// versioned returns an event converted for the connections subscriber, or
+// nil if it cannot be
+func (c *Connection) versioned(e *Event) *Event {
+	if c.subscriber == nil {
+		return e
+	}
+	return c.subscriber.version(e)
+}
+
+// acceptVersion returns the version parameter of the first media type in
+// an Accept header that has one, such as application/json; version=1, or
+// zero if none do
+func acceptVersion(accept string) int {
+	for _, mt := range strings.Split(accept, ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(mt))
+		if err != nil {
+			continue
+		}
+
+		if v, err := strconv.Atoi(params["version"]); err == nil && v > 0 {
+			return v
+		}
+	}
+
+	return 0
+}